@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// RoomRule matches rooms for access control. All fields that are set must match.
+type RoomRule struct {
+	RoomID id.RoomID `json:"room_id,omitempty" yaml:"room_id"`
+	// DM matches DMs if true or group chats if false.
+	DM *bool `json:"dm,omitempty" yaml:"dm"`
+	// Network matches rooms bridged to the given network, e.g. "whatsapp".
+	Network string `json:"network,omitempty" yaml:"network"`
+	// Space matches rooms in the given space, including rooms in its sub-spaces.
+	Space id.RoomID `json:"space,omitempty" yaml:"space"`
+}
+
+// RoomAccessRules are the rooms an API user can access.
+// A room is accessible if it matches any allow rule (or there are none) and doesn't match any deny rule.
+type RoomAccessRules struct {
+	Allow []RoomRule `json:"allow,omitempty" yaml:"allow"`
+	Deny  []RoomRule `json:"deny,omitempty" yaml:"deny"`
+}
+
+// AccessRules maps API usernames to their room access rules. Users without rules can access every room.
+type AccessRules map[string]*RoomAccessRules
+
+// readAccessRulesFile reads room access rules from a JSON file, which was the only format before ingestor.yaml.
+func readAccessRulesFile(path string) (AccessRules, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read access rules: %w", err)
+	}
+	var rules AccessRules
+	if err = json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse access rules: %w", err)
+	}
+	return rules, nil
+}
+
+func (ar AccessRules) validate() error {
+	for username, userRules := range ar {
+		if userRules == nil {
+			return fmt.Errorf("access rules of %s are null", username)
+		}
+		for _, rule := range slices.Concat(userRules.Allow, userRules.Deny) {
+			if rule == (RoomRule{}) {
+				return fmt.Errorf("access rules of %s contain an empty rule, which would match every room", username)
+			}
+		}
+	}
+	return nil
+}
+
+func (rar *RoomAccessRules) usesSpaces() bool {
+	return slices.ContainsFunc(slices.Concat(rar.Allow, rar.Deny), func(rule RoomRule) bool {
+		return rule.Space != ""
+	})
+}
+
+// roomAttributes are the properties of a room that access rules can match on.
+type roomAttributes struct {
+	Network string
+	DM      bool
+	Spaces  map[id.RoomID]struct{}
+}
+
+func (rule *RoomRule) matches(roomID id.RoomID, attrs *roomAttributes) bool {
+	if rule.RoomID != "" && rule.RoomID != roomID {
+		return false
+	} else if rule.DM != nil && *rule.DM != attrs.DM {
+		return false
+	} else if rule.Network != "" && rule.Network != attrs.Network {
+		return false
+	} else if rule.Space != "" {
+		if _, inSpace := attrs.Spaces[rule.Space]; !inSpace {
+			return false
+		}
+	}
+	return true
+}
+
+func (rar *RoomAccessRules) allows(roomID id.RoomID, attrs *roomAttributes) bool {
+	matches := func(rule RoomRule) bool {
+		return rule.matches(roomID, attrs)
+	}
+	return (len(rar.Allow) == 0 || slices.ContainsFunc(rar.Allow, matches)) && !slices.ContainsFunc(rar.Deny, matches)
+}
+
+// RoomFilter is the set of rooms an API user can access. A nil filter allows every room.
+type RoomFilter map[id.RoomID]struct{}
+
+// Allows checks if the given room is in the filter.
+func (rf RoomFilter) Allows(roomID id.RoomID) bool {
+	if rf == nil {
+		return true
+	}
+	_, ok := rf[roomID]
+	return ok
+}
+
+// MarshalJSON encodes the filter as an array of room IDs, which queries can use with json_each.
+func (rf RoomFilter) MarshalJSON() ([]byte, error) {
+	roomIDs := make([]id.RoomID, 0, len(rf))
+	for roomID := range rf {
+		roomIDs = append(roomIDs, roomID)
+	}
+	return json.Marshal(roomIDs)
+}
+
+// GetRoomFilter evaluates the access rules of an API user against the rooms in the database.
+func (ab *BeeperIngestor) GetRoomFilter(ctx context.Context, username string) (RoomFilter, error) {
+	rules, ok := ab.Config().Auth.AccessRules[username]
+	if !ok {
+		return nil, nil
+	}
+	roomIDs, err := ab.GetAllRoomIDs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rooms: %w", err)
+	}
+	networks, err := ab.GetRoomNetworks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room networks: %w", err)
+	}
+	dms, err := ab.GetDirectChats(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get direct chats: %w", err)
+	}
+	var roomSpaces map[id.RoomID]map[id.RoomID]struct{}
+	if rules.usesSpaces() {
+		children, err := ab.GetSpaceChildren(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get space children: %w", err)
+		}
+		roomSpaces = make(map[id.RoomID]map[id.RoomID]struct{})
+		for _, rule := range slices.Concat(rules.Allow, rules.Deny) {
+			if rule.Space != "" {
+				for _, roomID := range spaceDescendants(children, rule.Space) {
+					if roomSpaces[roomID] == nil {
+						roomSpaces[roomID] = make(map[id.RoomID]struct{})
+					}
+					roomSpaces[roomID][rule.Space] = struct{}{}
+				}
+			}
+		}
+	}
+	filter := make(RoomFilter)
+	for _, roomID := range roomIDs {
+		_, isDM := dms[roomID]
+		attrs := &roomAttributes{
+			Network: networks[roomID],
+			DM:      isDM,
+			Spaces:  roomSpaces[roomID],
+		}
+		if rules.allows(roomID, attrs) {
+			filter[roomID] = struct{}{}
+		}
+	}
+	return filter, nil
+}
+
+// spaceDescendants returns all rooms under a space, following sub-spaces.
+func spaceDescendants(children map[id.RoomID][]id.RoomID, spaceID id.RoomID) []id.RoomID {
+	visited := map[id.RoomID]struct{}{spaceID: {}}
+	var descendants []id.RoomID
+	queue := []id.RoomID{spaceID}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+		for _, child := range children[current] {
+			if _, seen := visited[child]; seen {
+				continue
+			}
+			visited[child] = struct{}{}
+			descendants = append(descendants, child)
+			queue = append(queue, child)
+		}
+	}
+	return descendants
+}
+
+// Restrict returns a filter that only allows the given rooms out of the rooms this filter allows.
+func (rf RoomFilter) Restrict(roomIDs []id.RoomID) RoomFilter {
+	restricted := make(RoomFilter, len(roomIDs))
+	for _, roomID := range roomIDs {
+		if rf.Allows(roomID) {
+			restricted[roomID] = struct{}{}
+		}
+	}
+	return restricted
+}
+
+// requestRoomFilter gets the room filter of the API user making the request.
+// If it fails, it writes an error response and returns false.
+func (ab *BeeperIngestor) requestRoomFilter(w http.ResponseWriter, r *http.Request) (RoomFilter, bool) {
+	user := apiUserFromContext(r.Context())
+	filter, err := ab.GetRoomFilter(r.Context(), user.Name)
+	if err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to evaluate room access rules")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to check room access"))
+		return nil, false
+	}
+	if user.Rooms != nil {
+		filter = filter.Restrict(user.Rooms)
+	}
+	return filter, true
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+func TestRoomAccessRulesAllows(t *testing.T) {
+	yes, no := true, false
+	whatsappDM := &roomAttributes{Network: "whatsapp", DM: true}
+	whatsappGroup := &roomAttributes{Network: "whatsapp"}
+	inSpace := &roomAttributes{Spaces: map[id.RoomID]struct{}{"!space:example.com": {}}}
+	tests := []struct {
+		name   string
+		rules  RoomAccessRules
+		roomID id.RoomID
+		attrs  *roomAttributes
+		want   bool
+	}{
+		{"no rules", RoomAccessRules{}, "!a:example.com", &roomAttributes{}, true},
+		{"room ID allowed", RoomAccessRules{Allow: []RoomRule{{RoomID: "!a:example.com"}}}, "!a:example.com", &roomAttributes{}, true},
+		{"room ID not allowed", RoomAccessRules{Allow: []RoomRule{{RoomID: "!a:example.com"}}}, "!b:example.com", &roomAttributes{}, false},
+		{"network and DM", RoomAccessRules{Allow: []RoomRule{{Network: "whatsapp", DM: &yes}}}, "!a:example.com", whatsappDM, true},
+		{"network but not DM", RoomAccessRules{Allow: []RoomRule{{Network: "whatsapp", DM: &yes}}}, "!a:example.com", whatsappGroup, false},
+		{"group chats only", RoomAccessRules{Allow: []RoomRule{{DM: &no}}}, "!a:example.com", whatsappGroup, true},
+		{"other network", RoomAccessRules{Allow: []RoomRule{{Network: "signal"}}}, "!a:example.com", whatsappDM, false},
+		{"any allow rule", RoomAccessRules{Allow: []RoomRule{{Network: "signal"}, {Network: "whatsapp"}}}, "!a:example.com", whatsappDM, true},
+		{"denied", RoomAccessRules{Deny: []RoomRule{{DM: &yes}}}, "!a:example.com", whatsappDM, false},
+		{"deny wins over allow", RoomAccessRules{
+			Allow: []RoomRule{{Network: "whatsapp"}},
+			Deny:  []RoomRule{{RoomID: "!a:example.com"}},
+		}, "!a:example.com", whatsappDM, false},
+		{"in space", RoomAccessRules{Allow: []RoomRule{{Space: "!space:example.com"}}}, "!a:example.com", inSpace, true},
+		{"not in space", RoomAccessRules{Allow: []RoomRule{{Space: "!space:example.com"}}}, "!a:example.com", whatsappDM, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rules.allows(tt.roomID, tt.attrs); got != tt.want {
+				t.Errorf("allows(%s) = %t, want %t", tt.roomID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpaceDescendants(t *testing.T) {
+	children := map[id.RoomID][]id.RoomID{
+		"!space:example.com": {"!a:example.com", "!sub:example.com"},
+		"!sub:example.com":   {"!b:example.com", "!space:example.com"},
+		"!other:example.com": {"!c:example.com"},
+	}
+	got := spaceDescendants(children, "!space:example.com")
+	slices.Sort(got)
+	want := []id.RoomID{"!a:example.com", "!b:example.com", "!sub:example.com"}
+	if !slices.Equal(got, want) {
+		t.Errorf("spaceDescendants() = %v, want %v", got, want)
+	}
+}
+
+func TestRoomFilterRestrict(t *testing.T) {
+	var all RoomFilter
+	if got := all.Restrict([]id.RoomID{"!a:example.com"}); !got.Allows("!a:example.com") || got.Allows("!b:example.com") {
+		t.Errorf("nil filter restricted to !a = %v", got)
+	}
+	filter := RoomFilter{"!a:example.com": {}}
+	if got := filter.Restrict([]id.RoomID{"!a:example.com", "!b:example.com"}); len(got) != 1 || !got.Allows("!a:example.com") {
+		t.Errorf("filter restricted to !a and !b = %v, want only !a", got)
+	}
+}
+
+func TestAuthConfigUserScopes(t *testing.T) {
+	ac := &AuthConfig{
+		AccessRules: AccessRules{
+			"contractor": {Allow: []RoomRule{{Network: "whatsapp"}}},
+			"auditor":    {Allow: []RoomRule{{Network: "whatsapp"}}},
+		},
+		Scopes: map[string][]Scope{
+			"auditor": {ScopeMessagesRead, ScopeAdmin},
+			"bot":     {ScopeSend},
+		},
+	}
+	tests := []struct {
+		username string
+		want     []Scope
+	}{
+		{"admin", nil},
+		{"contractor", readOnlyScopes},
+		{"auditor", []Scope{ScopeMessagesRead, ScopeAdmin}},
+		{"bot", []Scope{ScopeSend}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.username, func(t *testing.T) {
+			got := ac.userScopes(tt.username)
+			if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("userScopes(%s) = %v, want %v", tt.username, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseAccessScopes(t *testing.T) {
+	got, err := parseAccessScopes("alice=messages:read,media:read|bob=admin")
+	if err != nil {
+		t.Fatalf("parseAccessScopes() error = %v", err)
+	}
+	if !slices.Equal(got["alice"], []Scope{ScopeMessagesRead, ScopeMediaRead}) || !slices.Equal(got["bob"], []Scope{ScopeAdmin}) {
+		t.Errorf("parseAccessScopes() = %v", got)
+	}
+	for _, raw := range []string{"alice", "=admin", "alice=bogus"} {
+		if _, err = parseAccessScopes(raw); err == nil {
+			t.Errorf("parseAccessScopes(%q) didn't fail", raw)
+		}
+	}
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ArchiveFormatVersion is bumped whenever the layout of the archive or the manifest changes incompatibly.
+const ArchiveFormatVersion = 1
+
+// ArchiveManifest describes the contents of a chat archive. It's stored as manifest.json at the root of the zip.
+type ArchiveManifest struct {
+	FormatVersion   int                `json:"format_version"`
+	ExportedAt      jsontime.UnixMilli `json:"exported_at"`
+	ExportedBy      id.UserID          `json:"exported_by"`
+	IngestorVersion string             `json:"ingestor_version"`
+	Rooms           []*ArchiveRoom     `json:"rooms"`
+}
+
+type ArchiveRoom struct {
+	ID           id.RoomID       `json:"id"`
+	Name         string          `json:"name"`
+	Transcript   string          `json:"transcript"`
+	MessageCount int             `json:"message_count"`
+	Media        []*ArchiveMedia `json:"media"`
+}
+
+type ArchiveMedia struct {
+	EventID  id.EventID `json:"event_id"`
+	MXC      string     `json:"mxc"`
+	Path     string     `json:"path,omitempty"`
+	FileName string     `json:"file_name,omitempty"`
+	MimeType string     `json:"mime_type,omitempty"`
+	Size     int64      `json:"size,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
+type ArchiveOptions struct {
+	IncludeMedia bool
+}
+
+var archiveTemplate = template.Must(template.New("archive").Parse(`
+{{- define "header" -}}
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: -apple-system, BlinkMacSystemFont, "Segoe UI", Roboto, Helvetica, Arial, sans-serif; max-width: 60rem; margin: 2rem auto; padding: 0 1rem; }
+header { border-bottom: 1px solid #ccc; margin-bottom: 1rem; }
+.meta { color: #666; font-size: .875rem; }
+ol { list-style: none; padding: 0; }
+li { padding: .5rem 0; border-bottom: 1px solid #eee; }
+.sender { font-weight: bold; }
+.body { white-space: pre-wrap; overflow-wrap: anywhere; }
+.deleted { color: #888; font-style: italic; }
+img, video { max-width: 100%; max-height: 30rem; display: block; margin-top: .25rem; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Name}}</h1>
+<p class="meta">{{.ID}} &middot; exported {{.ExportedAt.UTC.Format "2006-01-02 15:04:05 MST"}}</p>
+</header>
+<ol>
+{{end -}}
+
+{{- define "message" -}}
+<li id="{{.ID}}">
+<div class="meta"><span class="sender" title="{{.SenderID}}">{{.SenderName}}</span> &middot; <time datetime="{{.Timestamp.UTC.Format "2006-01-02T15:04:05Z07:00"}}">{{.Timestamp.UTC.Format "2006-01-02 15:04:05"}}</time>{{if .Edited}} &middot; edited{{end}}</div>
+{{- if .Deleted}}
+<div class="body deleted">Message deleted</div>
+{{- else if .Undecryptable}}
+<div class="body deleted">Message could not be decrypted</div>
+{{- else}}
+{{- if .Body}}
+<div class="body">{{.Body}}</div>
+{{- end}}
+{{- with .Media}}
+{{- if .Path}}
+{{- if eq .Kind "image"}}
+<a href="{{.Path}}"><img src="{{.Path}}" alt="{{.FileName}}"></a>
+{{- else if eq .Kind "video"}}
+<video src="{{.Path}}" controls></video>
+{{- else if eq .Kind "audio"}}
+<audio src="{{.Path}}" controls></audio>
+{{- else}}
+<a href="{{.Path}}">{{.FileName}}</a>
+{{- end}}
+{{- else}}
+<div class="deleted">Attachment {{.FileName}} could not be exported: {{.Error}}</div>
+{{- end}}
+{{- end}}
+{{- end}}
+</li>
+{{end -}}
+
+{{- define "footer" -}}
+</ol>
+</body>
+</html>
+{{end -}}
+`))
+
+type archiveTranscriptHeader struct {
+	ID         id.RoomID
+	Name       string
+	ExportedAt time.Time
+}
+
+type archiveTranscriptMedia struct {
+	Kind     string
+	Path     string
+	FileName string
+	Error    string
+}
+
+type archiveTranscriptMessage struct {
+	ID         id.EventID
+	SenderID   id.UserID
+	SenderName string
+	Timestamp  time.Time
+	Body       string
+	Edited     bool
+	Deleted    bool
+	// Undecryptable is set for encrypted messages that failed to decrypt.
+	Undecryptable bool
+	Media         *archiveTranscriptMedia
+}
+
+type archiveWriter struct {
+	ab   *BeeperIngestor
+	zip  *zip.Writer
+	opts ArchiveOptions
+
+	manifest ArchiveManifest
+}
+
+// WriteArchive writes a zip archive of the given rooms to w and returns its manifest.
+//
+// The archive contains a static HTML transcript for each room, the media referenced by the messages
+// (downloaded and decrypted with the gomuks client) and a manifest.json describing everything.
+func (ab *BeeperIngestor) WriteArchive(ctx context.Context, w io.Writer, rooms []*database.Room, opts ArchiveOptions) (*ArchiveManifest, error) {
+	aw := &archiveWriter{
+		ab:   ab,
+		zip:  zip.NewWriter(w),
+		opts: opts,
+		manifest: ArchiveManifest{
+			FormatVersion:   ArchiveFormatVersion,
+			ExportedAt:      jsontime.UnixMilliNow(),
+			ExportedBy:      ab.gmx.Client.Account.UserID,
+			IngestorVersion: Version,
+			Rooms:           make([]*ArchiveRoom, 0, len(rooms)),
+		},
+	}
+	for i, room := range rooms {
+		err := aw.writeRoom(ctx, fmt.Sprintf("rooms/%03d", i+1), room)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write room %s: %w", room.ID, err)
+		}
+	}
+	manifestWriter, err := aw.zip.Create("manifest.json")
+	if err != nil {
+		return nil, err
+	}
+	encoder := json.NewEncoder(manifestWriter)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(&aw.manifest); err != nil {
+		return nil, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return &aw.manifest, aw.zip.Close()
+}
+
+func (aw *archiveWriter) writeRoom(ctx context.Context, dir string, room *database.Room) error {
+	log := zerolog.Ctx(ctx).With().Stringer("room_id", room.ID).Logger()
+	archiveRoom := &ArchiveRoom{
+		ID:         room.ID,
+		Name:       room.ID.String(),
+		Transcript: path.Join(dir, "index.html"),
+		Media:      make([]*ArchiveMedia, 0),
+	}
+	if room.Name != nil && *room.Name != "" {
+		archiveRoom.Name = *room.Name
+	}
+	aw.manifest.Rooms = append(aw.manifest.Rooms, archiveRoom)
+
+	// Media files are written to the zip while the transcript is being generated,
+	// so the transcript is buffered in a temp file and copied into the zip at the end.
+	transcript, err := os.CreateTemp(aw.ab.gmx.TempDir, "transcript-*.html")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file for transcript: %w", err)
+	}
+	defer func() {
+		_ = transcript.Close()
+		_ = os.Remove(transcript.Name())
+	}()
+	err = archiveTemplate.ExecuteTemplate(transcript, "header", &archiveTranscriptHeader{
+		ID:         room.ID,
+		Name:       archiveRoom.Name,
+		ExportedAt: aw.manifest.ExportedAt.Time,
+	})
+	if err != nil {
+		return err
+	}
+
+	senderNames := make(map[id.UserID]string)
+	params := ExportMessagesQuery{RoomID: room.ID, Limit: exportBatchSize}
+	for {
+		events, err := aw.ab.ExportMessagesDatabaseQuery(ctx, params)
+		if err != nil {
+			return fmt.Errorf("failed to query timeline: %w", err)
+		}
+		for _, evt := range events {
+			if evt.RelationType == event.RelReplace {
+				continue
+			}
+			msg := aw.transcriptMessage(ctx, evt, senderNames)
+			if !msg.Deleted && !msg.Undecryptable && aw.opts.IncludeMedia {
+				msg.Media = aw.writeMedia(ctx, dir, archiveRoom, evt)
+			}
+			if err = archiveTemplate.ExecuteTemplate(transcript, "message", msg); err != nil {
+				return err
+			}
+			archiveRoom.MessageCount++
+		}
+		if len(events) < params.Limit {
+			break
+		}
+		last := events[len(events)-1]
+		params.AfterTS = last.Timestamp.UnixMilli()
+		params.AfterRowID = last.RowID
+	}
+	if err = archiveTemplate.ExecuteTemplate(transcript, "footer", nil); err != nil {
+		return err
+	}
+
+	if _, err = transcript.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	transcriptWriter, err := aw.zip.Create(archiveRoom.Transcript)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(transcriptWriter, transcript); err != nil {
+		return fmt.Errorf("failed to copy transcript into archive: %w", err)
+	}
+	log.Debug().Int("message_count", archiveRoom.MessageCount).Msg("Wrote room to archive")
+	return nil
+}
+
+// archiveContent returns the content of the latest edit of the event, or the event's own content if it hasn't been edited.
+func (aw *archiveWriter) archiveContent(ctx context.Context, evt *database.Event) (*event.MessageEventContent, bool) {
+	var content event.MessageEventContent
+	_ = json.Unmarshal(rawMessageContent(evt), &content)
+	if evt.LastEditRowID == nil || *evt.LastEditRowID == 0 {
+		return &content, false
+	}
+	edit, err := aw.ab.gmx.Client.DB.Event.GetByRowID(ctx, *evt.LastEditRowID)
+	if err != nil || edit == nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("event_id", evt.ID).Msg("Failed to get last edit of event")
+		return &content, false
+	}
+	var editContent event.MessageEventContent
+	if err = json.Unmarshal(rawMessageContent(edit), &editContent); err != nil || editContent.NewContent == nil {
+		return &content, false
+	}
+	return editContent.NewContent, true
+}
+
+func (aw *archiveWriter) transcriptMessage(ctx context.Context, evt *database.Event, senderNames map[id.UserID]string) *archiveTranscriptMessage {
+	msg := &archiveTranscriptMessage{
+		ID:         evt.ID,
+		SenderID:   evt.Sender,
+		SenderName: aw.senderName(ctx, evt.RoomID, evt.Sender, senderNames),
+		Timestamp:  evt.Timestamp.Time,
+		Deleted:    evt.RedactedBy != "",
+	}
+	msg.Undecryptable = !msg.Deleted && failedToDecrypt(evt)
+	if !msg.Deleted && !msg.Undecryptable {
+		var content *event.MessageEventContent
+		content, msg.Edited = aw.archiveContent(ctx, evt)
+		msg.Body = content.Body
+	}
+	return msg
+}
+
+func (aw *archiveWriter) senderName(ctx context.Context, roomID id.RoomID, userID id.UserID, cache map[id.UserID]string) string {
+	if name, ok := cache[userID]; ok {
+		return name
+	}
+	name := userID.String()
+	member, err := aw.ab.gmx.Client.DB.CurrentState.Get(ctx, roomID, event.StateMember, userID.String())
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("user_id", userID).Msg("Failed to get member info")
+	} else if member != nil {
+		var content event.MemberEventContent
+		if json.Unmarshal(member.Content, &content) == nil && content.Displayname != "" {
+			name = content.Displayname
+		}
+	}
+	cache[userID] = name
+	return name
+}
+
+func mediaKind(msgType event.MessageType) string {
+	switch msgType {
+	case event.MsgImage:
+		return "image"
+	case event.MsgVideo:
+		return "video"
+	case event.MsgAudio:
+		return "audio"
+	default:
+		return "file"
+	}
+}
+
+// sanitizeFileName makes a user-provided file name safe to use as a path component inside the archive.
+func sanitizeFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "." || name == ".." || name == "" {
+		return "file"
+	} else if len(name) > 100 {
+		ext := path.Ext(name)
+		if len(ext) > 20 {
+			ext = ""
+		}
+		name = name[:100-len(ext)] + ext
+	}
+	return name
+}
+
+func (aw *archiveWriter) writeMedia(ctx context.Context, dir string, room *ArchiveRoom, evt *database.Event) *archiveTranscriptMedia {
+	content, _ := aw.archiveContent(ctx, evt)
+	var mxc id.ContentURI
+	if content.File != nil {
+		mxc = content.File.URL.ParseOrIgnore()
+	} else {
+		mxc = content.URL.ParseOrIgnore()
+	}
+	if !mxc.IsValid() {
+		return nil
+	}
+	fileName := content.FileName
+	if fileName == "" {
+		fileName = content.Body
+	}
+	fileName = sanitizeFileName(fileName)
+	media := &ArchiveMedia{
+		EventID:  evt.ID,
+		MXC:      mxc.String(),
+		FileName: fileName,
+	}
+	if content.Info != nil {
+		media.MimeType = content.Info.MimeType
+	}
+	room.Media = append(room.Media, media)
+	transcriptMedia := &archiveTranscriptMedia{
+		Kind:     mediaKind(content.MsgType),
+		FileName: fileName,
+	}
+
+	err := aw.copyMedia(ctx, path.Join(dir, "media", fmt.Sprintf("%d-%s", evt.RowID, fileName)), mxc, content.File, media)
+	if err != nil {
+		zerolog.Ctx(ctx).Warn().Err(err).Stringer("event_id", evt.ID).Stringer("mxc", mxc).Msg("Failed to export media")
+		media.Error = err.Error()
+		media.Path = ""
+		transcriptMedia.Error = media.Error
+	} else {
+		// The transcript lives in the room directory, so links to media are relative to it
+		transcriptMedia.Path = strings.TrimPrefix(media.Path, dir+"/")
+	}
+	return transcriptMedia
+}
+
+// copyMedia downloads a file from the homeserver, decrypts it if necessary and writes it into the archive.
+// The file is buffered on disk first, so that a failed download or hash mismatch doesn't leave a corrupt entry in the zip.
+func (aw *archiveWriter) copyMedia(ctx context.Context, archivePath string, mxc id.ContentURI, file *event.EncryptedFileInfo, media *ArchiveMedia) error {
+	resp, err := aw.ab.gmx.Client.Client.Download(ctx, mxc)
+	if err != nil {
+		return fmt.Errorf("failed to download: %w", err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if media.MimeType == "" {
+		media.MimeType = resp.Header.Get("Content-Type")
+	}
+	if media.FileName == "" || media.FileName == "file" {
+		_, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
+		if params["filename"] != "" {
+			media.FileName = sanitizeFileName(params["filename"])
+		}
+	}
+
+	var reader io.Reader = resp.Body
+	var decryptStream io.ReadCloser
+	if file != nil {
+		if err = file.PrepareForDecryption(); err != nil {
+			return fmt.Errorf("failed to prepare for decryption: %w", err)
+		}
+		decryptStream = file.DecryptStream(resp.Body)
+		reader = decryptStream
+	}
+	tempFile, err := os.CreateTemp(aw.ab.gmx.TempDir, "archive-media-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+	media.Size, err = io.Copy(tempFile, reader)
+	if err != nil {
+		return fmt.Errorf("failed to read: %w", err)
+	}
+	if decryptStream != nil {
+		// Closing the decrypting reader verifies the hash of the file
+		if err = decryptStream.Close(); err != nil {
+			return fmt.Errorf("failed to decrypt: %w", err)
+		}
+	}
+	if _, err = tempFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	entry, err := aw.zip.CreateHeader(&zip.FileHeader{
+		Name:   archivePath,
+		Method: zip.Store,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(entry, tempFile); err != nil {
+		return fmt.Errorf("failed to copy into archive: %w", err)
+	}
+	media.Path = archivePath
+	return nil
+}
+
+// getArchiveRooms looks up the given rooms, returning an error if any of them don't exist.
+func (ab *BeeperIngestor) getArchiveRooms(ctx context.Context, roomIDs []id.RoomID) ([]*database.Room, error) {
+	rooms := make([]*database.Room, 0, len(roomIDs))
+	for _, roomID := range roomIDs {
+		room, err := ab.gmx.Client.DB.Room.Get(ctx, roomID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get room %s: %w", roomID, err)
+		} else if room == nil {
+			return nil, fmt.Errorf("%w: %s", errRoomNotFound, roomID)
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, nil
+}
+
+var errRoomNotFound = errors.New("room not found")
+
+// ExportArchive writes a zip archive of the rooms given in the room_id query parameters to the response.
+func (ab *BeeperIngestor) ExportArchive(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	query := r.URL.Query()
+	roomIDs := make([]id.RoomID, 0, len(query["room_id"]))
+	for _, roomID := range query["room_id"] {
+		roomIDs = append(roomIDs, id.RoomID(roomID))
+	}
+	if len(roomIDs) == 0 {
+		writeError(w, r, errInvalidParam("room_id", "At least one room_id parameter is required"))
+		return
+	}
+	opts := ArchiveOptions{IncludeMedia: query.Get("media") != "false"}
+	if opts.IncludeMedia && !apiUserFromContext(r.Context()).HasScope(ScopeMediaRead) {
+		writeError(w, r, withExtra(mautrix.MForbidden.WithMessage("Missing media:read scope, use media=false to export without media"), "scope", ScopeMediaRead))
+		return
+	}
+
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	}
+	for _, roomID := range roomIDs {
+		if !roomFilter.Allows(roomID) {
+			writeError(w, r, errNoSuchRoom("room_id").WithMessage(fmt.Errorf("%w: %s", errRoomNotFound, roomID).Error()))
+			return
+		}
+	}
+
+	rooms, err := ab.getArchiveRooms(r.Context(), roomIDs)
+	if errors.Is(err, errRoomNotFound) {
+		writeError(w, r, errNoSuchRoom("room_id").WithMessage(err.Error()))
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Failed to get rooms for archive")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get room info"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="archive-%s.zip"`, time.Now().UTC().Format("20060102-150405")))
+	w.WriteHeader(http.StatusOK)
+	audit := auditEntryFromContext(r.Context())
+	audit.AddRooms(roomIDs...)
+	manifest, err := ab.WriteArchive(log.WithContext(r.Context()), w, rooms, opts)
+	if manifest != nil {
+		messageCount := 0
+		for _, room := range manifest.Rooms {
+			messageCount += room.MessageCount
+		}
+		audit.SetResultCount(messageCount)
+	}
+	if err != nil {
+		// Headers have already been sent, so the client will just get a truncated zip
+		log.Err(err).Msg("Failed to write archive")
+	}
+}
+
+func cmdExport(gmx *gomuks.Gomuks, fs *CommandFlags) error {
+	format := fs.MakeFull("f", "format", "Export format: archive for a zip with HTML transcripts and media, or parquet for analytics.", "archive").String()
+	output := fs.MakeFull("o", "output", "Path to write to. Defaults to archive.zip for archives and ./parquet for Parquet exports.", "").String()
+	noMedia := fs.Make().LongKey("no-media").Usage("Don't download media into the archive.").Bool()
+	full := fs.Make().LongKey("full").Usage("Discard the previous Parquet export in the output directory and export all messages again.").Bool()
+	if ok, err := fs.Parse(); !ok {
+		return err
+	}
+	switch *format {
+	case "archive":
+		if fs.NArg() == 0 {
+			fs.PrintHelp()
+			return fmt.Errorf("at least one room ID is required")
+		} else if *full {
+			return fmt.Errorf("--full only applies to parquet exports")
+		} else if *output == "" {
+			*output = "archive.zip"
+		}
+	case "parquet":
+		if fs.NArg() > 0 {
+			return fmt.Errorf("parquet exports always include all rooms")
+		} else if *output == "" {
+			*output = "parquet"
+		}
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	if err := openClient(gmx); err != nil {
+		return err
+	}
+	defer closeClient(gmx)
+	ab := &BeeperIngestor{gmx: gmx}
+	ctx := gmx.Log.WithContext(context.Background())
+
+	if *format == "parquet" {
+		_, err := ab.ExportParquet(ctx, *output, *full)
+		return err
+	}
+	roomIDs := make([]id.RoomID, fs.NArg())
+	for i, roomID := range fs.Args() {
+		roomIDs[i] = id.RoomID(roomID)
+	}
+	rooms, err := ab.getArchiveRooms(ctx, roomIDs)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = ab.WriteArchive(ctx, file, rooms, ArchiveOptions{IncludeMedia: !*noMedia})
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	gmx.Log.Info().Str("path", *output).Int("room_count", len(rooms)).Msg("Archive written")
+	return nil
+}
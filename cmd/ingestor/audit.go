@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	getAuditEntryBaseQuery = `
+		SELECT id, timestamp, request_id, username, auth_method, remote_addr, method, path, query,
+		       status_code, room_ids, result_count, latency_ms
+		FROM audit_log
+	`
+	insertAuditEntryQuery = `
+		INSERT INTO audit_log (
+			timestamp, request_id, username, auth_method, remote_addr, method, path, query,
+			status_code, room_ids, result_count, latency_ms
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id
+	`
+	deleteAuditEntriesBeforeQuery = `
+		DELETE FROM audit_log WHERE timestamp < $1
+	`
+)
+
+// AuditQuery only has queries for adding and reading entries and for removing expired ones.
+// Entries are never modified.
+type AuditQuery struct {
+	*dbutil.QueryHelper[*AuditEntry]
+}
+
+func (aq *AuditQuery) Insert(ctx context.Context, entry *AuditEntry) error {
+	return aq.GetDB().QueryRow(ctx, insertAuditEntryQuery, entry.sqlVariables()...).Scan(&entry.ID)
+}
+
+// DeleteBefore removes entries older than the given time and returns how many were removed.
+func (aq *AuditQuery) DeleteBefore(ctx context.Context, before time.Time) (int64, error) {
+	res, err := aq.GetDB().Exec(ctx, deleteAuditEntriesBeforeQuery, before.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// AuditFilter selects audit log entries. Zero values don't filter anything.
+type AuditFilter struct {
+	Username string
+	Path     string
+	RoomID   id.RoomID
+	// Rooms limits the results to entries that only touched rooms in the filter. Entries without rooms are
+	// excluded too, as they may be requests for other users' data. A nil filter allows every entry.
+	Rooms RoomFilter
+	Since int64
+	Until int64
+	// BeforeID is a pagination cursor, only entries with a lower ID are returned
+	BeforeID int64
+	Limit    int
+}
+
+// Search returns the newest entries matching the filter.
+func (aq *AuditQuery) Search(ctx context.Context, filter AuditFilter) ([]*AuditEntry, error) {
+	conditions := []string{"1=1"}
+	args := make([]any, 0)
+
+	if filter.Username != "" {
+		conditions = append(conditions, "username = $"+strconv.Itoa(len(args)+1))
+		args = append(args, filter.Username)
+	}
+
+	if filter.Path != "" {
+		conditions = append(conditions, "path = $"+strconv.Itoa(len(args)+1))
+		args = append(args, filter.Path)
+	}
+
+	if filter.RoomID != "" {
+		conditions = append(conditions, "EXISTS (SELECT 1 FROM json_each(room_ids) WHERE value = $"+strconv.Itoa(len(args)+1)+")")
+		args = append(args, filter.RoomID)
+	}
+
+	if filter.Rooms != nil {
+		roomIDs, _ := json.Marshal(filter.Rooms)
+		conditions = append(conditions, "json_array_length(room_ids) > 0 AND NOT EXISTS "+
+			"(SELECT 1 FROM json_each(room_ids) WHERE value NOT IN (SELECT value FROM json_each($"+strconv.Itoa(len(args)+1)+")))")
+		args = append(args, string(roomIDs))
+	}
+
+	if filter.Since != 0 {
+		conditions = append(conditions, "timestamp >= $"+strconv.Itoa(len(args)+1))
+		args = append(args, filter.Since)
+	}
+
+	if filter.Until != 0 {
+		conditions = append(conditions, "timestamp < $"+strconv.Itoa(len(args)+1))
+		args = append(args, filter.Until)
+	}
+
+	if filter.BeforeID != 0 {
+		conditions = append(conditions, "id < $"+strconv.Itoa(len(args)+1))
+		args = append(args, filter.BeforeID)
+	}
+
+	query := getAuditEntryBaseQuery + `
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY id DESC
+		LIMIT $` + strconv.Itoa(len(args)+1)
+	args = append(args, filter.Limit)
+
+	return aq.QueryMany(ctx, query, args...)
+}
+
+// AuditEntry is the record of one API request.
+type AuditEntry struct {
+	ID        int64              `json:"id"`
+	Timestamp jsontime.UnixMilli `json:"timestamp"`
+	RequestID string             `json:"request_id"`
+	// Username and AuthMethod are empty if the request wasn't authenticated
+	Username   string     `json:"username,omitempty"`
+	AuthMethod string     `json:"auth_method,omitempty"`
+	RemoteAddr string     `json:"remote_addr"`
+	Method     string     `json:"method"`
+	Path       string     `json:"path"`
+	Query      url.Values `json:"query"`
+	StatusCode int        `json:"status_code"`
+	// RoomIDs are the rooms whose messages or metadata were returned
+	RoomIDs     []id.RoomID `json:"room_ids"`
+	ResultCount int         `json:"result_count"`
+	LatencyMS   int64       `json:"latency_ms"`
+}
+
+func (ae *AuditEntry) Scan(row dbutil.Scannable) (*AuditEntry, error) {
+	var username, authMethod sql.NullString
+	var query, roomIDs string
+	err := row.Scan(
+		&ae.ID, &ae.Timestamp, &ae.RequestID, &username, &authMethod, &ae.RemoteAddr, &ae.Method, &ae.Path, &query,
+		&ae.StatusCode, &roomIDs, &ae.ResultCount, &ae.LatencyMS,
+	)
+	if err != nil {
+		return nil, err
+	}
+	ae.Username = username.String
+	ae.AuthMethod = authMethod.String
+	if err = json.Unmarshal([]byte(query), &ae.Query); err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal([]byte(roomIDs), &ae.RoomIDs); err != nil {
+		return nil, err
+	}
+	return ae, nil
+}
+
+func (ae *AuditEntry) sqlVariables() []any {
+	query, _ := json.Marshal(ae.Query)
+	roomIDs, _ := json.Marshal(ae.RoomIDs)
+	return []any{
+		ae.Timestamp, ae.RequestID, dbutil.StrPtr(ae.Username), dbutil.StrPtr(ae.AuthMethod), ae.RemoteAddr,
+		ae.Method, ae.Path, string(query), ae.StatusCode, string(roomIDs), ae.ResultCount, ae.LatencyMS,
+	}
+}
+
+// AddRooms records that data from the given rooms was returned. It's a no-op outside audited requests.
+func (ae *AuditEntry) AddRooms(roomIDs ...id.RoomID) {
+	if ae == nil {
+		return
+	}
+	for _, roomID := range roomIDs {
+		if !slices.Contains(ae.RoomIDs, roomID) {
+			ae.RoomIDs = append(ae.RoomIDs, roomID)
+		}
+	}
+}
+
+// SetResultCount records how many items the request returned. It's a no-op outside audited requests.
+func (ae *AuditEntry) SetResultCount(count int) {
+	if ae != nil {
+		ae.ResultCount = count
+	}
+}
+
+// auditEntryFromContext returns the audit entry of the current request, or nil if the request isn't audited.
+func auditEntryFromContext(ctx context.Context) *AuditEntry {
+	entry, _ := ctx.Value(contextKeyAuditEntry).(*AuditEntry)
+	return entry
+}
+
+// statusResponseWriter remembers the status code of a response.
+// It implements Unwrap, so that http.ResponseController can still flush streamed responses.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+}
+
+func (srw *statusResponseWriter) WriteHeader(statusCode int) {
+	if srw.statusCode == 0 {
+		srw.statusCode = statusCode
+	}
+	srw.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (srw *statusResponseWriter) Write(data []byte) (int, error) {
+	if srw.statusCode == 0 {
+		srw.statusCode = http.StatusOK
+	}
+	return srw.ResponseWriter.Write(data)
+}
+
+func (srw *statusResponseWriter) Unwrap() http.ResponseWriter {
+	return srw.ResponseWriter
+}
+
+// probeAccessLogMiddleware logs the requests to the unauthenticated endpoints of the mux, which bypass
+// auditMiddleware. Orchestrators probe them every few seconds and /readyz fails until the initial sync is done,
+// so successful requests are logged at debug level and failed ones as warnings. Requests that fall through
+// to the API handler at "/" are logged by auditMiddleware instead.
+func probeAccessLogMiddleware(mux *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, pattern := mux.Handler(r); pattern == "/" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			start := time.Now()
+			srw := &statusResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(srw, r)
+			statusCode := max(srw.statusCode, http.StatusOK)
+			log := hlog.FromRequest(r)
+			evt := log.Debug()
+			if statusCode >= 400 {
+				evt = log.Warn()
+			}
+			evt.Str("remote_addr", r.RemoteAddr).
+				Str("method", r.Method).
+				Str("request_uri", r.RequestURI).
+				Int("status_code", statusCode).
+				Int64("request_time_ms", time.Since(start).Milliseconds()).
+				Msg("Access")
+		})
+	}
+}
+
+// auditMiddleware logs every request and stores it in the audit log after it's finished.
+// Handlers add the rooms and result count with auditEntryFromContext, and authMiddleware adds the user.
+func (ab *BeeperIngestor) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID, _ := hlog.IDFromRequest(r)
+		entry := &AuditEntry{
+			Timestamp:  jsontime.UM(start),
+			RequestID:  requestID.String(),
+			RemoteAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      r.URL.Query(),
+			RoomIDs:    make([]id.RoomID, 0),
+		}
+		srw := &statusResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(srw, r.WithContext(context.WithValue(r.Context(), contextKeyAuditEntry, entry)))
+		entry.StatusCode = max(srw.statusCode, http.StatusOK)
+		entry.LatencyMS = time.Since(start).Milliseconds()
+
+		log := hlog.FromRequest(r)
+		var evt *zerolog.Event
+		if entry.StatusCode >= 500 {
+			evt = log.Error()
+		} else if entry.StatusCode >= 400 {
+			evt = log.Warn()
+		} else {
+			evt = log.Info()
+		}
+		evt.Str("remote_addr", entry.RemoteAddr).
+			Str("method", entry.Method).
+			Str("request_uri", r.RequestURI).
+			Str("username", entry.Username).
+			Int("status_code", entry.StatusCode).
+			Int("result_count", entry.ResultCount).
+			Int64("request_time_ms", entry.LatencyMS).
+			Msg("Access")
+
+		// The client may have disconnected already, but the entry should still be written
+		if err := ab.db.Audit.Insert(context.WithoutCancel(r.Context()), entry); err != nil {
+			log.Err(err).Msg("Failed to write audit log entry")
+		}
+	})
+}
+
+// auditLogPruneInterval is how often entries older than the retention period are removed.
+const auditLogPruneInterval = time.Hour
+
+// pruneAuditLog periodically removes audit log entries older than the configured retention period.
+func (ab *BeeperIngestor) pruneAuditLog() {
+	log := ab.gmx.Log.With().Str("component", "audit_log_pruner").Logger()
+	ctx := log.WithContext(context.Background())
+	ticker := time.NewTicker(auditLogPruneInterval)
+	defer ticker.Stop()
+	for {
+		if retention := ab.Config().Retention.AuditLog; retention > 0 {
+			deleted, err := ab.db.Audit.DeleteBefore(ctx, time.Now().Add(-retention))
+			if err != nil {
+				log.Err(err).Msg("Failed to prune audit log")
+			} else if deleted > 0 {
+				log.Info().Int64("deleted", deleted).Msg("Pruned expired audit log entries")
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// AuditLogResponse is the response of the audit log endpoint.
+type AuditLogResponse struct {
+	Entries    []*AuditEntry `json:"entries"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// GetAuditLog returns audit log entries, newest first.
+// Users with room access rules only see entries about the rooms they can access.
+func (ab *BeeperIngestor) GetAuditLog(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	}
+	query := r.URL.Query()
+	filter := AuditFilter{
+		Username: query.Get("username"),
+		Path:     query.Get("path"),
+		RoomID:   id.RoomID(query.Get("room_id")),
+		Rooms:    roomFilter,
+		Limit:    100,
+	}
+	if filter.RoomID != "" && !roomFilter.Allows(filter.RoomID) {
+		writeError(w, r, errNoSuchRoom("room_id"))
+		return
+	}
+	intParams := []struct {
+		name string
+		dest *int64
+	}{
+		{"since", &filter.Since},
+		{"until", &filter.Until},
+		{"cursor", &filter.BeforeID},
+	}
+	for _, param := range intParams {
+		if val := query.Get(param.name); val != "" {
+			parsed, err := strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				writeError(w, r, errInvalidParam(param.name, "Invalid %s parameter", param.name))
+				return
+			}
+			*param.dest = parsed
+		}
+	}
+	if limitStr := query.Get("limit"); limitStr != "" {
+		limit, err := strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 {
+			writeError(w, r, errInvalidParam("limit", "Invalid limit parameter"))
+			return
+		}
+		filter.Limit = min(limit, 1000)
+	}
+
+	entries, err := ab.db.Audit.Search(r.Context(), filter)
+	if err != nil {
+		log.Err(err).Msg("Failed to query audit log")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to query audit log"))
+		return
+	}
+	resp := &AuditLogResponse{Entries: entries}
+	if resp.Entries == nil {
+		resp.Entries = []*AuditEntry{}
+	} else if len(entries) == filter.Limit {
+		resp.NextCursor = strconv.FormatInt(entries[len(entries)-1].ID, 10)
+	}
+	auditEntryFromContext(r.Context()).SetResultCount(len(resp.Entries))
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Err(err).Msg("Failed to encode response")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+func newTestIngestorDatabase(t *testing.T) *IngestorDatabase {
+	t.Helper()
+	parent, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = parent.Close() })
+	db := newIngestorDatabase(parent)
+	if err = db.Upgrade(context.Background()); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	return db
+}
+
+func TestAuditSearchRoomFilter(t *testing.T) {
+	ctx := context.Background()
+	db := newTestIngestorDatabase(t)
+	for _, roomIDs := range [][]id.RoomID{
+		nil,
+		{"!a:example.com"},
+		{"!a:example.com", "!b:example.com"},
+		{"!b:example.com"},
+		{"!c:example.com"},
+	} {
+		if err := db.Audit.Insert(ctx, &AuditEntry{Method: "GET", Path: "/v1/messages", RoomIDs: roomIDs}); err != nil {
+			t.Fatalf("failed to insert entry: %v", err)
+		}
+	}
+	tests := []struct {
+		name   string
+		filter AuditFilter
+		want   []int64
+	}{
+		{"no filter", AuditFilter{}, []int64{5, 4, 3, 2, 1}},
+		{"one room", AuditFilter{Rooms: RoomFilter{"!a:example.com": {}}}, []int64{2}},
+		{"two rooms", AuditFilter{Rooms: RoomFilter{"!a:example.com": {}, "!b:example.com": {}}}, []int64{4, 3, 2}},
+		{"no rooms", AuditFilter{Rooms: RoomFilter{}}, nil},
+		{"room ID within filter", AuditFilter{RoomID: "!b:example.com", Rooms: RoomFilter{"!b:example.com": {}}}, []int64{4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.Limit = 100
+			entries, err := db.Audit.Search(ctx, tt.filter)
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			var got []int64
+			for _, entry := range entries {
+				got = append(got, entry.ID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Search() returned entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
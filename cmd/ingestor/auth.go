@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/random"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// APIUser is the identity of an authenticated API request.
+type APIUser struct {
+	// Name is the API username, which is also the key for room access rules.
+	Name string
+	// Scopes are the permissions of the request, nil means all scopes.
+	Scopes []Scope
+	// Rooms restricts the user to the given rooms on top of the room access rules, nil means no extra restriction.
+	Rooms []id.RoomID
+	// Method is the name of the authenticator that accepted the request, e.g. "basic", "token" or "jwt".
+	Method string
+}
+
+func (u *APIUser) HasScope(scope Scope) bool {
+	return u.Scopes == nil || slices.Contains(u.Scopes, scope)
+}
+
+// errInvalidCredentials is returned by authenticators when a request has credentials of their type, but they're wrong.
+var errInvalidCredentials = errors.New("invalid credentials")
+
+// Authenticator checks one kind of credentials in requests.
+type Authenticator interface {
+	// Authenticate returns the user of the request, or nil if the request doesn't contain credentials of this kind.
+	// If the credentials are present but not valid, it returns an error wrapping errInvalidCredentials.
+	Authenticate(r *http.Request) (*APIUser, error)
+	// Challenge is the value for the WWW-Authenticate header when no credentials were given.
+	Challenge() string
+}
+
+type contextKey int
+
+const (
+	contextKeyAPIUser contextKey = iota
+	contextKeyAuditEntry
+)
+
+// apiUserFromContext returns the authenticated API user of a request.
+func apiUserFromContext(ctx context.Context) *APIUser {
+	user, _ := ctx.Value(contextKeyAPIUser).(*APIUser)
+	return user
+}
+
+// authMiddleware authenticates requests with the first authenticator that recognizes their credentials.
+// Requests from locked out usernames or IPs are rejected before their credentials are checked.
+// The authenticators are fetched for each request, as they're rebuilt when the config is reloaded.
+func authMiddleware(lockout *AuthLockout, getAuthenticators func() []Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authenticators := getAuthenticators()
+			if wait := lockout.Check(r); wait > 0 {
+				writeError(w, r, errRetryAfter(w, "Too many failed authentication attempts", wait))
+				return
+			}
+			for _, auth := range authenticators {
+				user, err := auth.Authenticate(r)
+				if errors.Is(err, errInvalidCredentials) {
+					hlog.FromRequest(r).Debug().Err(err).Msg("Rejected request with invalid credentials")
+					lockout.RecordFailure(r)
+					writeError(w, r, mautrix.MUnknownToken.WithMessage("Invalid credentials"))
+					return
+				} else if err != nil {
+					hlog.FromRequest(r).Err(err).Msg("Failed to authenticate request")
+					writeError(w, r, mautrix.MUnknown.WithMessage("Failed to authenticate request"))
+					return
+				} else if user != nil {
+					lockout.RecordSuccess(r)
+					if entry := auditEntryFromContext(r.Context()); entry != nil {
+						entry.Username = user.Name
+						entry.AuthMethod = user.Method
+					}
+					next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKeyAPIUser, user)))
+					return
+				}
+			}
+			var challenges []string
+			for _, auth := range authenticators {
+				if challenge := auth.Challenge(); challenge != "" && !slices.Contains(challenges, challenge) {
+					challenges = append(challenges, challenge)
+					w.Header().Add("WWW-Authenticate", challenge)
+				}
+			}
+			writeError(w, r, mautrix.MMissingToken.WithMessage("Missing credentials"))
+		})
+	}
+}
+
+// requireScope wraps a handler so that it's only accessible to users with the given scope.
+func requireScope(scope Scope, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !apiUserFromContext(r.Context()).HasScope(scope) {
+			writeError(w, r, withExtra(mautrix.MForbidden.WithMessage("Missing %s scope", scope), "scope", scope))
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// basicAuthenticator checks HTTP Basic credentials against the users in ACCESS_LIST.
+// The scopes of the users come from auth.scopes, see AuthConfig.userScopes.
+type basicAuthenticator struct {
+	auth     *AuthConfig
+	verified *verifiedPasswordCache
+}
+
+func newBasicAuthenticator(auth *AuthConfig) *basicAuthenticator {
+	return &basicAuthenticator{auth: auth, verified: newVerifiedPasswordCache()}
+}
+
+func (ba *basicAuthenticator) Challenge() string {
+	return `Basic realm="Restricted"`
+}
+
+func (ba *basicAuthenticator) Authenticate(r *http.Request) (*APIUser, error) {
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	storedHash, exists := ba.auth.AccessList[username]
+	if !exists {
+		verifyPassword(dummyPasswordHash(), []byte(password))
+		return nil, fmt.Errorf("%w: unknown user %s", errInvalidCredentials, username)
+	}
+	if !ba.verified.Check(username, []byte(password)) {
+		if !verifyPassword(storedHash, []byte(password)) {
+			return nil, fmt.Errorf("%w: wrong password for %s", errInvalidCredentials, username)
+		}
+		ba.verified.Add(username, []byte(password))
+	}
+	return &APIUser{Name: username, Scopes: ba.auth.userScopes(username), Method: "basic"}, nil
+}
+
+// tokenLastUsedPrecision is how outdated the last used timestamp of a token can be before it's updated,
+// so that busy clients don't cause a database write on every request.
+const tokenLastUsedPrecision = time.Minute
+
+// tokenAuthenticator checks bearer tokens created with `ingestor token create`.
+type tokenAuthenticator struct {
+	db *IngestorDatabase
+}
+
+func (ta *tokenAuthenticator) Challenge() string {
+	return `Bearer realm="Restricted"`
+}
+
+func (ta *tokenAuthenticator) Authenticate(r *http.Request) (*APIUser, error) {
+	plaintext, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	} else if !random.IsToken(tokenNamespace, plaintext) {
+		return nil, fmt.Errorf("%w: malformed token", errInvalidCredentials)
+	}
+	token, err := ta.db.Token.GetByToken(r.Context(), plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get token: %w", err)
+	} else if token == nil {
+		return nil, fmt.Errorf("%w: unknown token", errInvalidCredentials)
+	} else if token.IsExpired() {
+		return nil, fmt.Errorf("%w: token %d expired", errInvalidCredentials, token.ID)
+	}
+	if time.Since(token.LastUsedAt.Time) > tokenLastUsedPrecision {
+		if err = ta.db.Token.UpdateLastUsed(r.Context(), token); err != nil {
+			hlog.FromRequest(r).Warn().Err(err).Int64("token_id", token.ID).Msg("Failed to update token last used timestamp")
+		}
+	}
+	return &APIUser{Name: token.Username, Scopes: token.Scopes, Method: "token"}, nil
+}
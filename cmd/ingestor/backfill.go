@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// BackfillConfig controls which rooms the backfill worker fetches history for and how far back it goes.
+type BackfillConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Rooms to backfill, or nil for all joined rooms.
+	Rooms []id.RoomID `yaml:"rooms"`
+	// MaxEvents is the maximum number of events to fetch per room, 0 for no limit.
+	MaxEvents int `yaml:"max_events"`
+	// Until is the date to stop at, the zero time for no limit.
+	Until time.Time `yaml:"until"`
+	// BatchSize is the number of events requested per /messages call.
+	BatchSize int `yaml:"batch_size"`
+	// Delay is how long to wait between requests to avoid hitting homeserver rate limits.
+	Delay time.Duration `yaml:"delay"`
+}
+
+// applyEnv reads the BACKFILL_* environment variables. Setting BACKFILL_ROOMS enables backfilling.
+func (cfg *BackfillConfig) applyEnv() error {
+	switch rooms := os.Getenv("BACKFILL_ROOMS"); rooms {
+	case "":
+	case "all":
+		cfg.Enabled = true
+		cfg.Rooms = nil
+	default:
+		cfg.Enabled = true
+		cfg.Rooms = nil
+		for _, roomID := range strings.Split(rooms, ",") {
+			cfg.Rooms = append(cfg.Rooms, id.RoomID(strings.TrimSpace(roomID)))
+		}
+	}
+	if val := os.Getenv("BACKFILL_UNTIL"); val != "" {
+		var err error
+		if cfg.Until, err = time.Parse(time.DateOnly, val); err != nil {
+			if cfg.Until, err = time.Parse(time.RFC3339, val); err != nil {
+				return fmt.Errorf("invalid BACKFILL_UNTIL %q, expected YYYY-MM-DD or an RFC 3339 timestamp", val)
+			}
+		}
+	}
+	return errors.Join(
+		envInt("BACKFILL_MAX_EVENTS", &cfg.MaxEvents),
+		envInt("BACKFILL_BATCH_SIZE", &cfg.BatchSize),
+		envDuration("BACKFILL_DELAY", &cfg.Delay),
+	)
+}
+
+func (cfg *BackfillConfig) validate() error {
+	if cfg.MaxEvents < 0 {
+		return fmt.Errorf("max_events can't be negative")
+	} else if cfg.BatchSize <= 0 || cfg.BatchSize > 1000 {
+		return fmt.Errorf("batch_size must be between 1 and 1000")
+	} else if cfg.Delay < 0 {
+		return fmt.Errorf("delay can't be negative")
+	}
+	return nil
+}
+
+type BackfillStatus string
+
+const (
+	BackfillStatusPending BackfillStatus = "pending"
+	BackfillStatusRunning BackfillStatus = "running"
+	// BackfillStatusComplete means the start of the room was reached.
+	BackfillStatusComplete BackfillStatus = "complete"
+	// BackfillStatusLimitReached means the configured depth or date was reached before the start of the room.
+	BackfillStatusLimitReached BackfillStatus = "limit_reached"
+	// BackfillStatusFailed means the last attempt failed, it will be retried on the next pass.
+	BackfillStatusFailed BackfillStatus = "failed"
+)
+
+const (
+	getBackfillProgressBaseQuery = `
+		SELECT room_id, status, event_count, oldest_timestamp, last_error, updated_at FROM backfill_progress
+	`
+	getBackfillProgressQuery    = getBackfillProgressBaseQuery + `WHERE room_id = $1`
+	getAllBackfillProgressQuery = getBackfillProgressBaseQuery + `ORDER BY room_id`
+	putBackfillProgressQuery    = `
+		INSERT INTO backfill_progress (room_id, status, event_count, oldest_timestamp, last_error, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (room_id) DO UPDATE
+			SET status = excluded.status,
+			    event_count = excluded.event_count,
+			    oldest_timestamp = excluded.oldest_timestamp,
+			    last_error = excluded.last_error,
+			    updated_at = excluded.updated_at
+	`
+	// A room is backfilled if the own user is joined to it, which hicli tracks in current_state.
+	getJoinedRoomsQuery = `
+		SELECT room_id FROM current_state
+		WHERE event_type = 'm.room.member' AND state_key = $1 AND membership = 'join'
+		ORDER BY room_id
+	`
+)
+
+type BackfillProgressQuery struct {
+	*dbutil.QueryHelper[*BackfillProgress]
+}
+
+func (bpq *BackfillProgressQuery) Get(ctx context.Context, roomID id.RoomID) (*BackfillProgress, error) {
+	return bpq.QueryOne(ctx, getBackfillProgressQuery, roomID)
+}
+
+func (bpq *BackfillProgressQuery) GetAll(ctx context.Context) ([]*BackfillProgress, error) {
+	return bpq.QueryMany(ctx, getAllBackfillProgressQuery)
+}
+
+func (bpq *BackfillProgressQuery) Put(ctx context.Context, bp *BackfillProgress) error {
+	bp.UpdatedAt = jsontime.UM(time.Now())
+	return bpq.Exec(ctx, putBackfillProgressQuery, bp.sqlVariables()...)
+}
+
+// BackfillProgress is the backfill state of a single room.
+type BackfillProgress struct {
+	RoomID     id.RoomID      `json:"room_id"`
+	Status     BackfillStatus `json:"status"`
+	EventCount int            `json:"event_count"`
+	// OldestTimestamp is the timestamp of the oldest event fetched so far, 0 if nothing has been fetched.
+	OldestTimestamp jsontime.UnixMilli `json:"oldest_timestamp"`
+	LastError       string             `json:"last_error,omitempty"`
+	UpdatedAt       jsontime.UnixMilli `json:"updated_at"`
+}
+
+func (bp *BackfillProgress) Scan(row dbutil.Scannable) (*BackfillProgress, error) {
+	var oldestTS sql.NullInt64
+	var lastError sql.NullString
+	err := row.Scan(&bp.RoomID, &bp.Status, &bp.EventCount, &oldestTS, &lastError, &bp.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if oldestTS.Valid {
+		bp.OldestTimestamp = jsontime.UMInt(oldestTS.Int64)
+	}
+	bp.LastError = lastError.String
+	return bp, nil
+}
+
+func (bp *BackfillProgress) sqlVariables() []any {
+	var oldestTS *int64
+	if !bp.OldestTimestamp.IsZero() {
+		oldestTS = new(int64)
+		*oldestTS = bp.OldestTimestamp.UnixMilli()
+	}
+	return []any{bp.RoomID, bp.Status, bp.EventCount, oldestTS, dbutil.StrPtr(bp.LastError), bp.UpdatedAt}
+}
+
+// backfillRescanInterval is how often the worker looks for new rooms after finishing a pass over all rooms.
+const backfillRescanInterval = 10 * time.Minute
+
+// BackfillWorker fetches older history of rooms in the background using hicli's pagination.
+//
+// hicli stores the pagination token of each room, so the worker continues from where it left off after a restart.
+// The progress table only records what the worker has done for reporting and to enforce the configured limits.
+type BackfillWorker struct {
+	ab     *BeeperIngestor
+	log    zerolog.Logger
+	config BackfillConfig
+
+	syncDone     chan struct{}
+	syncDoneOnce sync.Once
+	unsubscribe  func()
+	stop         context.CancelFunc
+	stopped      chan struct{}
+}
+
+// NewBackfillWorker creates a worker and starts listening for sync completions.
+// It must be created before the client is started so that it doesn't miss the first sync.
+func (ab *BeeperIngestor) NewBackfillWorker(config BackfillConfig) *BackfillWorker {
+	bw := &BackfillWorker{
+		ab:       ab,
+		log:      ab.gmx.Log.With().Str("component", "backfill").Logger(),
+		config:   config,
+		syncDone: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	bw.unsubscribe = ab.gmx.SubscribeEvents(func(websocket.StatusCode, string) {}, func(cmd *hicli.JSONCommand) {
+		if cmd.Command == "sync_complete" {
+			bw.syncDoneOnce.Do(func() {
+				close(bw.syncDone)
+			})
+		}
+	})
+	return bw
+}
+
+// Start runs the worker in a background goroutine if backfilling is enabled.
+func (bw *BackfillWorker) Start() {
+	if !bw.config.Enabled {
+		close(bw.stopped)
+		return
+	}
+	var ctx context.Context
+	ctx, bw.stop = context.WithCancel(bw.log.WithContext(context.Background()))
+	go bw.run(ctx)
+}
+
+// Stop stops the worker and waits for the current request to finish.
+func (bw *BackfillWorker) Stop() {
+	bw.unsubscribe()
+	if bw.stop != nil {
+		bw.stop()
+	}
+	<-bw.stopped
+}
+
+func (bw *BackfillWorker) run(ctx context.Context) {
+	defer close(bw.stopped)
+	// Pagination tokens are only valid once the client has synced
+	select {
+	case <-bw.syncDone:
+	case <-ctx.Done():
+		return
+	}
+	bw.log.Info().
+		Int("configured_rooms", len(bw.config.Rooms)).
+		Int("max_events", bw.config.MaxEvents).
+		Time("until", bw.config.Until).
+		Msg("Starting backfill")
+	for {
+		rooms, err := bw.getRooms(ctx)
+		if err != nil {
+			bw.log.Err(err).Msg("Failed to get rooms to backfill")
+		}
+		for _, roomID := range rooms {
+			if err = bw.backfillRoom(ctx, roomID); ctx.Err() != nil {
+				return
+			} else if err != nil {
+				bw.log.Err(err).Stringer("room_id", roomID).Msg("Failed to backfill room")
+			}
+		}
+		select {
+		case <-time.After(backfillRescanInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (bw *BackfillWorker) getRooms(ctx context.Context) ([]id.RoomID, error) {
+	if bw.config.Rooms != nil {
+		return bw.config.Rooms, nil
+	}
+	h := bw.ab.gmx.Client
+	rows, err := h.DB.Query(ctx, getJoinedRoomsQuery, h.Account.UserID)
+	return dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[id.RoomID], err).AsList()
+}
+
+// limitReached checks whether the configured depth or date limit has been reached for a room.
+func (bw *BackfillWorker) limitReached(progress *BackfillProgress) bool {
+	return (bw.config.MaxEvents > 0 && progress.EventCount >= bw.config.MaxEvents) ||
+		(!bw.config.Until.IsZero() && !progress.OldestTimestamp.IsZero() && !progress.OldestTimestamp.After(bw.config.Until))
+}
+
+func (bw *BackfillWorker) backfillRoom(ctx context.Context, roomID id.RoomID) error {
+	db := bw.ab.db.Backfill
+	progress, err := db.Get(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get progress: %w", err)
+	} else if progress == nil {
+		progress = &BackfillProgress{RoomID: roomID, Status: BackfillStatusPending}
+	} else if progress.Status == BackfillStatusComplete {
+		return nil
+	}
+	if room, err := bw.ab.gmx.Client.DB.Room.Get(ctx, roomID); err != nil {
+		return fmt.Errorf("failed to get room: %w", err)
+	} else if room == nil {
+		// The progress table references the room table, and there's nothing to paginate in unknown rooms anyway
+		bw.log.Warn().Stringer("room_id", roomID).Msg("Configured room to backfill is not known to the client")
+		return nil
+	}
+	log := bw.log.With().Stringer("room_id", roomID).Logger()
+	delay := bw.config.Delay
+	for {
+		if bw.limitReached(progress) {
+			if progress.Status != BackfillStatusLimitReached {
+				progress.Status = BackfillStatusLimitReached
+				log.Debug().Int("event_count", progress.EventCount).Msg("Backfill limit reached")
+				return db.Put(ctx, progress)
+			}
+			return nil
+		}
+		limit := bw.config.BatchSize
+		if bw.config.MaxEvents > 0 {
+			limit = min(limit, bw.config.MaxEvents-progress.EventCount)
+		}
+		resp, err := bw.ab.gmx.Client.PaginateServer(ctx, roomID, limit)
+		if errors.Is(err, hicli.ErrPaginationAlreadyInProgress) {
+			// Someone else is paginating the room, try again on the next pass
+			return nil
+		} else if errors.Is(err, mautrix.MLimitExceeded) {
+			delay = min(max(delay*2, time.Second), 5*time.Minute)
+			log.Warn().Err(err).Dur("retry_in", delay).Msg("Rate limited while backfilling")
+		} else if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			progress.Status = BackfillStatusFailed
+			progress.LastError = err.Error()
+			if putErr := db.Put(ctx, progress); putErr != nil {
+				log.Err(putErr).Msg("Failed to save backfill progress")
+			}
+			return err
+		} else {
+			delay = bw.config.Delay
+			progress.Status = BackfillStatusRunning
+			progress.LastError = ""
+			progress.EventCount += len(resp.Events)
+			bw.ab.metrics.RecordEvents("backfill", resp.Events)
+			for _, evt := range resp.Events {
+				if progress.OldestTimestamp.IsZero() || evt.Timestamp.Before(progress.OldestTimestamp.Time) {
+					progress.OldestTimestamp = evt.Timestamp
+				}
+			}
+			if !resp.HasMore {
+				progress.Status = BackfillStatusComplete
+			}
+			if err = db.Put(ctx, progress); err != nil {
+				return fmt.Errorf("failed to save progress: %w", err)
+			}
+			log.Debug().
+				Int("fetched", len(resp.Events)).
+				Int("event_count", progress.EventCount).
+				Time("oldest_timestamp", progress.OldestTimestamp.Time).
+				Msg("Backfilled batch")
+			if progress.Status == BackfillStatusComplete {
+				log.Info().Int("event_count", progress.EventCount).Msg("Reached start of room")
+				return nil
+			}
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// BackfillStatusResponse is the response of the backfill progress endpoints.
+type BackfillStatusResponse struct {
+	Enabled bool                `json:"enabled"`
+	Rooms   []*BackfillProgress `json:"rooms"`
+}
+
+// GetBackfillStatus returns the backfill progress of all rooms, or of a single room if the roomID path parameter is set.
+func (ab *BeeperIngestor) GetBackfillStatus(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	resp := &BackfillStatusResponse{Enabled: ab.backfill.config.Enabled}
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	}
+	if roomID := id.RoomID(r.PathValue("roomID")); roomID != "" {
+		progress, err := ab.db.Backfill.Get(r.Context(), roomID)
+		if err == nil && !roomFilter.Allows(roomID) {
+			progress = nil
+		}
+		if err != nil {
+			log.Err(err).Msg("Failed to get backfill progress")
+			writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get backfill progress"))
+			return
+		} else if progress == nil {
+			writeError(w, r, withExtra(mautrix.MNotFound.WithMessage("No backfill progress for room"), "param", "roomID"))
+			return
+		}
+		resp.Rooms = []*BackfillProgress{progress}
+	} else {
+		var err error
+		resp.Rooms, err = ab.db.Backfill.GetAll(r.Context())
+		if err != nil {
+			log.Err(err).Msg("Failed to get backfill progress")
+			writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get backfill progress"))
+			return
+		}
+		resp.Rooms = slices.DeleteFunc(resp.Rooms, func(progress *BackfillProgress) bool {
+			return !roomFilter.Allows(progress.RoomID)
+		})
+		if resp.Rooms == nil {
+			resp.Rooms = []*BackfillProgress{}
+		}
+	}
+	audit := auditEntryFromContext(r.Context())
+	for _, progress := range resp.Rooms {
+		audit.AddRooms(progress.RoomID)
+	}
+	audit.SetResultCount(len(resp.Rooms))
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Err(err).Msg("Failed to encode response")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/util/dbutil"
+	flag "maunium.net/go/mauflag"
+)
+
+// Command is a subcommand of the ingestor binary, e.g. `ingestor export`.
+type Command struct {
+	Usage       string
+	Description string
+	Run         func(gmx *gomuks.Gomuks, fs *CommandFlags) error
+}
+
+var commands = map[string]*Command{
+	"export": {
+		Usage:       "export [-h] [-f archive|parquet] [-o path] [--no-media] [--full] [room ID...]",
+		Description: "Write a zip archive of the given rooms, or export all messages to Parquet files for analytics.",
+		Run:         cmdExport,
+	},
+	"hash-password": {
+		Usage:       "hash-password [-h] [-a argon2id|bcrypt] [-u username]",
+		Description: "Hash a password read from stdin for use in ACCESS_LIST.",
+		Run:         cmdHashPassword,
+	},
+	"login": {
+		Usage:       "login [-h] [-s homeserver] [-u user | --token | -e email] [-l listen address]",
+		Description: "Log in with a password or login token read from stdin, or with a Beeper email code, and create the config if it doesn't exist.",
+		Run:         cmdLogin,
+	},
+	"import": {
+		Usage:       "import [-h] [-r room ID] [--no-decrypt] <file...>",
+		Description: "Load Element \"Export chat\" JSON files or raw Matrix event dumps into the searchable store.",
+		Run:         cmdImport,
+	},
+	"keys": {
+		Usage:       "keys [-h] export|import [-o path] [--since date] [--until date] [room ID...|path]",
+		Description: "Export megolm room keys to an encrypted key export file, or import one. The passphrase is read from stdin.",
+		Run:         cmdKeys,
+	},
+	"token": {
+		Usage:       "token [-h] create|list|revoke [-l label] [-u user] [-s scopes] [-e expiry] [token ID]",
+		Description: "Manage the bearer tokens that can be used to access the API.",
+		Run:         cmdToken,
+	},
+	"verify": {
+		Usage:       "verify [-h] --recovery-key",
+		Description: "Verify the device with the recovery key read from stdin and restore the server-side key backup.",
+		Run:         cmdVerify,
+	},
+}
+
+func printCommands() {
+	fmt.Println()
+	fmt.Println("Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		fmt.Printf("  %s\n      %s\n", commands[name].Usage, commands[name].Description)
+	}
+}
+
+// CommandFlags is the flag set of a subcommand with the standard help flag.
+type CommandFlags struct {
+	*flag.Set
+	wantHelp *bool
+}
+
+// Parse parses the flags of the subcommand.
+// It returns false if the command shouldn't continue because the help page was printed instead.
+func (fs *CommandFlags) Parse() (bool, error) {
+	if err := fs.Set.Parse(); err != nil {
+		fs.PrintHelp()
+		return false, err
+	} else if *fs.wantHelp {
+		fs.PrintHelp()
+		return false, nil
+	}
+	return true, nil
+}
+
+// runCommand runs a subcommand and exits the process with an appropriate status code.
+func runCommand(gmx *gomuks.Gomuks, name string, cmd *Command, args []string) {
+	fs := &CommandFlags{Set: flag.New(args)}
+	fs.SetHelpTitles(fmt.Sprintf("ingestor %s - %s", name, cmd.Description), "ingestor "+cmd.Usage)
+	fs.wantHelp, _ = fs.MakeHelpFlag()
+	err := cmd.Run(gmx, fs)
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// errNotLoggedIn is returned by loadAccount if the database doesn't have an account yet.
+var errNotLoggedIn = errors.New("not logged in")
+
+// openClient opens the gomuks database and prepares the client with the stored credentials without starting to sync.
+// It's meant for subcommands that need to read data or make requests but shouldn't run the full ingestor.
+func openClient(gmx *gomuks.Gomuks) error {
+	if err := openDatabase(gmx); err != nil {
+		return err
+	}
+	return loadAccount(gmx)
+}
+
+// openDatabase opens and upgrades the gomuks database without loading an account.
+func openDatabase(gmx *gomuks.Gomuks) error {
+	prepareGomuks(gmx)
+	return upgradeDatabase(gmx)
+}
+
+// upgradeDatabase opens and upgrades the gomuks database after the config has been loaded.
+func upgradeDatabase(gmx *gomuks.Gomuks) error {
+	if err := newClient(gmx, func(any) {}); err != nil {
+		return err
+	}
+	ctx := gmx.Log.WithContext(context.Background())
+	if err := gmx.Client.DB.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade hicli db: %w", err)
+	} else if err = gmx.Client.CryptoStore.DB.Upgrade(ctx); err != nil {
+		return fmt.Errorf("failed to upgrade crypto db: %w", err)
+	}
+	return nil
+}
+
+// newClient opens the gomuks database and creates the client with the given event handler.
+func newClient(gmx *gomuks.Gomuks, evtHandler func(any)) error {
+	rawDB, err := dbutil.NewFromConfig("gomuks", dbutil.Config{
+		PoolConfig: dbutil.PoolConfig{
+			Type:         "sqlite3-fk-wal",
+			URI:          fmt.Sprintf("file:%s/gomuks.db?_txlock=immediate", gmx.DataDir),
+			MaxOpenConns: 5,
+			MaxIdleConns: 1,
+		},
+	}, dbutil.ZeroLogger(gmx.Log.With().Str("component", "hicli").Str("db_section", "main").Logger()))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %w", err)
+	}
+	gmx.Client = hicli.New(
+		rawDB,
+		nil,
+		gmx.Log.With().Str("component", "hicli").Logger(),
+		[]byte("meow"),
+		evtHandler,
+	)
+	return nil
+}
+
+// loadAccount loads the stored account into the client opened by openDatabase and prepares the olm machine.
+func loadAccount(gmx *gomuks.Gomuks) error {
+	ctx := gmx.Log.WithContext(context.Background())
+	userID, err := gmx.Client.DB.Account.GetFirstUserID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get first user ID: %w", err)
+	} else if userID == "" {
+		return errNotLoggedIn
+	}
+	account, err := gmx.Client.DB.Account.Get(ctx, userID)
+	if err != nil {
+		return fmt.Errorf("failed to get account: %w", err)
+	}
+	h := gmx.Client
+	h.Account = account
+	h.CryptoStore.AccountID = account.UserID.String()
+	h.CryptoStore.DeviceID = account.DeviceID
+	h.Client.UserID = account.UserID
+	h.Client.DeviceID = account.DeviceID
+	h.Client.AccessToken = account.AccessToken
+	h.Client.HomeserverURL, err = url.Parse(account.HomeserverURL)
+	if err != nil {
+		return fmt.Errorf("failed to parse homeserver URL: %w", err)
+	}
+	if err = h.Crypto.Load(ctx); err != nil {
+		return fmt.Errorf("failed to load olm machine: %w", err)
+	}
+	return nil
+}
+
+// openIngestorDatabase opens the gomuks database and upgrades the ingestor's own tables in it.
+// The database should be closed with closeClient.
+func openIngestorDatabase(gmx *gomuks.Gomuks) (*IngestorDatabase, error) {
+	if err := openDatabase(gmx); err != nil {
+		return nil, err
+	}
+	db := newIngestorDatabase(gmx.Client.DB.Database)
+	if err := db.Upgrade(gmx.Log.WithContext(context.Background())); err != nil {
+		closeClient(gmx)
+		return nil, fmt.Errorf("failed to upgrade ingestor db: %w", err)
+	}
+	return db, nil
+}
+
+// closeClient closes the database opened by openClient.
+func closeClient(gmx *gomuks.Gomuks) {
+	if err := gmx.Client.DB.Close(); err != nil {
+		gmx.Log.Err(err).Msg("Failed to close database cleanly")
+	}
+}
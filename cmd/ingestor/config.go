@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mautrix/id"
+)
+
+// IngestorConfig is the configuration of the ingestor itself, loaded from ingestor.yaml.
+// The gomuks config.yaml next to it is still used for the listen address and the gomuks client.
+// Environment variables override the values in the file.
+type IngestorConfig struct {
+	Auth       AuthConfig      `yaml:"auth"`
+	Listener   ListenerConfig  `yaml:"listener"`
+	Limits     LimitsConfig    `yaml:"limits"`
+	Backfill   BackfillConfig  `yaml:"backfill"`
+	Permalinks PermalinkConfig `yaml:"permalinks"`
+	Retention  RetentionConfig `yaml:"retention"`
+	Readiness  ReadinessConfig `yaml:"readiness"`
+	Shutdown   ShutdownConfig  `yaml:"shutdown"`
+	Device     DeviceConfig    `yaml:"device"`
+	Endpoints  map[string]bool `yaml:"endpoints"`
+}
+
+type AuthConfig struct {
+	// AccessList maps Basic auth usernames to password hashes.
+	AccessList  map[string]string `yaml:"access_list"`
+	AccessRules AccessRules       `yaml:"access_rules"`
+	// Scopes limits the scopes of Basic auth and client certificate users. Users without an entry have every scope,
+	// unless they have access rules, which makes them read-only.
+	Scopes  map[string][]Scope `yaml:"scopes"`
+	Lockout LockoutConfig      `yaml:"lockout"`
+	// JWT enables JWT bearer authentication if set.
+	JWT *JWTConfig `yaml:"jwt"`
+}
+
+type LimitsConfig struct {
+	// DefaultSearchLimit is the number of messages returned by searches without a limit parameter.
+	DefaultSearchLimit int `yaml:"default_search_limit"`
+	// MaxSearchLimit caps the limit parameter of searches.
+	MaxSearchLimit int             `yaml:"max_search_limit"`
+	RateLimit      RateLimitConfig `yaml:"rate_limit"`
+}
+
+// PermalinkConfig contains the URL templates of message and room links in API responses.
+// {room_id} and {event_id} are replaced with the IDs.
+type PermalinkConfig struct {
+	Room  string `yaml:"room"`
+	Event string `yaml:"event"`
+}
+
+func (pc *PermalinkConfig) RoomURL(roomID id.RoomID) string {
+	return strings.ReplaceAll(pc.Room, "{room_id}", roomID.String())
+}
+
+func (pc *PermalinkConfig) EventURL(roomID id.RoomID, eventID id.EventID) string {
+	return strings.NewReplacer("{room_id}", roomID.String(), "{event_id}", eventID.String()).Replace(pc.Event)
+}
+
+type RetentionConfig struct {
+	// AuditLog is how long audit log entries are kept, 0 keeps them forever.
+	AuditLog time.Duration `yaml:"audit_log"`
+}
+
+// Names of the endpoints that can be disabled in the endpoints section.
+const (
+	EndpointSearchMessages = "search_messages"
+	EndpointExportRoom     = "export_room"
+	EndpointArchive        = "archive"
+	EndpointBackfill       = "backfill"
+	EndpointAuditLog       = "audit_log"
+	EndpointMetrics        = "metrics"
+	EndpointOpenAPI        = "openapi"
+	EndpointEncryption     = "encryption"
+)
+
+var allEndpoints = []string{EndpointSearchMessages, EndpointExportRoom, EndpointArchive, EndpointBackfill, EndpointAuditLog, EndpointMetrics, EndpointOpenAPI, EndpointEncryption}
+
+// EndpointEnabled checks if an endpoint is enabled. Endpoints that aren't mentioned in the config are enabled.
+func (cfg *IngestorConfig) EndpointEnabled(name string) bool {
+	enabled, ok := cfg.Endpoints[name]
+	return !ok || enabled
+}
+
+func defaultIngestorConfig() *IngestorConfig {
+	return &IngestorConfig{
+		Auth: AuthConfig{
+			Lockout: LockoutConfig{
+				MaxFailures:  5,
+				BaseDuration: 30 * time.Second,
+				MaxDuration:  time.Hour,
+				ResetAfter:   time.Hour,
+			},
+		},
+		Limits: LimitsConfig{
+			DefaultSearchLimit: 100,
+			MaxSearchLimit:     1000,
+			RateLimit:          RateLimitConfig{PerSecond: 10, Burst: 200},
+		},
+		Backfill: BackfillConfig{BatchSize: 100, Delay: 2 * time.Second},
+		Permalinks: PermalinkConfig{
+			Room:  "https://matrix.to/#/{room_id}",
+			Event: "https://matrix.to/#/{room_id}/{event_id}",
+		},
+		Readiness: ReadinessConfig{MaxSyncAge: 5 * time.Minute},
+		Shutdown:  ShutdownConfig{DrainTimeout: 30 * time.Second},
+	}
+}
+
+// ingestorConfigPath returns the path of ingestor.yaml, which can be changed with INGESTOR_CONFIG.
+func ingestorConfigPath(configDir string) (path string, explicit bool) {
+	if path = os.Getenv("INGESTOR_CONFIG"); path != "" {
+		return path, true
+	}
+	return filepath.Join(configDir, "ingestor.yaml"), false
+}
+
+// loadIngestorConfig reads the config file, applies environment variable overrides and validates the result.
+// A missing file is only an error if its path was set explicitly, otherwise the defaults are used.
+func loadIngestorConfig(path string, explicit bool) (*IngestorConfig, error) {
+	cfg := defaultIngestorConfig()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && !explicit {
+		// Only environment variables are used
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	if err = cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err = cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (cfg *IngestorConfig) applyEnv() error {
+	if raw := os.Getenv("DISABLED_ENDPOINTS"); raw != "" {
+		if cfg.Endpoints == nil {
+			cfg.Endpoints = make(map[string]bool)
+		}
+		for _, name := range strings.Split(raw, ",") {
+			cfg.Endpoints[strings.TrimSpace(name)] = false
+		}
+	}
+	envString("PERMALINK_ROOM_FORMAT", &cfg.Permalinks.Room)
+	envString("PERMALINK_EVENT_FORMAT", &cfg.Permalinks.Event)
+	envString("DEVICE_NAME", &cfg.Device.Name)
+	return errors.Join(
+		cfg.Auth.applyEnv(),
+		cfg.Listener.applyEnv(),
+		envInt("SEARCH_DEFAULT_LIMIT", &cfg.Limits.DefaultSearchLimit),
+		envInt("SEARCH_MAX_LIMIT", &cfg.Limits.MaxSearchLimit),
+		cfg.Limits.RateLimit.applyEnv(),
+		cfg.Backfill.applyEnv(),
+		envDuration("AUDIT_LOG_RETENTION", &cfg.Retention.AuditLog),
+		cfg.Readiness.applyEnv(),
+		cfg.Shutdown.applyEnv(),
+	)
+}
+
+func (cfg *IngestorConfig) validate() error {
+	var errs []error
+	section := func(name string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	section("auth", cfg.Auth.validate())
+	section("listener", cfg.Listener.validate())
+	section("limits.rate_limit", cfg.Limits.RateLimit.validate())
+	section("backfill", cfg.Backfill.validate())
+	section("readiness", cfg.Readiness.validate())
+	section("shutdown", cfg.Shutdown.validate())
+	if cfg.Limits.MaxSearchLimit < 1 {
+		errs = append(errs, fmt.Errorf("limits.max_search_limit must be positive"))
+	} else if cfg.Limits.DefaultSearchLimit < 1 || cfg.Limits.DefaultSearchLimit > cfg.Limits.MaxSearchLimit {
+		errs = append(errs, fmt.Errorf("limits.default_search_limit must be between 1 and max_search_limit"))
+	}
+	if !strings.Contains(cfg.Permalinks.Room, "{room_id}") {
+		errs = append(errs, fmt.Errorf("permalinks.room must contain {room_id}"))
+	}
+	if !strings.Contains(cfg.Permalinks.Event, "{room_id}") || !strings.Contains(cfg.Permalinks.Event, "{event_id}") {
+		errs = append(errs, fmt.Errorf("permalinks.event must contain {room_id} and {event_id}"))
+	}
+	if cfg.Retention.AuditLog < 0 {
+		errs = append(errs, fmt.Errorf("retention.audit_log can't be negative"))
+	}
+	for name := range cfg.Endpoints {
+		if !slices.Contains(allEndpoints, name) {
+			errs = append(errs, fmt.Errorf("unknown endpoint %q, must be one of %s", name, strings.Join(allEndpoints, ", ")))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (ac *AuthConfig) applyEnv() error {
+	var errs []error
+	if raw := os.Getenv("ACCESS_LIST"); raw != "" {
+		accessList, err := parseAccessList(raw)
+		errs = append(errs, err)
+		ac.AccessList = accessList
+	}
+	if path := os.Getenv("ACCESS_RULES_FILE"); path != "" {
+		rules, err := readAccessRulesFile(path)
+		errs = append(errs, err)
+		ac.AccessRules = rules
+	}
+	if raw := os.Getenv("ACCESS_SCOPES"); raw != "" {
+		scopes, err := parseAccessScopes(raw)
+		errs = append(errs, err)
+		ac.Scopes = scopes
+	}
+	if os.Getenv("JWT_JWKS") != "" && ac.JWT == nil {
+		ac.JWT = &JWTConfig{}
+	}
+	if ac.JWT != nil {
+		ac.JWT.applyEnv()
+	}
+	errs = append(errs, ac.Lockout.applyEnv())
+	return errors.Join(errs...)
+}
+
+func (ac *AuthConfig) validate() error {
+	var errs []error
+	for username, hash := range ac.AccessList {
+		if username == "" || strings.ContainsAny(username, ":|") {
+			errs = append(errs, fmt.Errorf("invalid username %q in access_list", username))
+		} else if err := validatePasswordHash(hash); err != nil {
+			errs = append(errs, fmt.Errorf("invalid password hash for user %s: %w", username, err))
+		}
+	}
+	for username, scopes := range ac.Scopes {
+		if len(scopes) == 0 {
+			errs = append(errs, fmt.Errorf("scopes of user %s can't be empty", username))
+		}
+		for _, scope := range scopes {
+			if !slices.Contains(allScopes, scope) {
+				errs = append(errs, fmt.Errorf("unknown scope %q for user %s", scope, username))
+			}
+		}
+	}
+	if err := ac.AccessRules.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("access_rules: %w", err))
+	}
+	if err := ac.Lockout.validate(); err != nil {
+		errs = append(errs, fmt.Errorf("lockout: %w", err))
+	}
+	if ac.JWT != nil {
+		if err := ac.JWT.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("jwt: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// parseAccessList parses the ACCESS_LIST environment variable in the user:hash|user2:hash2 format.
+func parseAccessList(raw string) (map[string]string, error) {
+	accessList := make(map[string]string)
+	for _, pair := range strings.Split(raw, "|") {
+		username, hash, ok := strings.Cut(pair, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid ACCESS_LIST format, expected user:hashedpass|user2:hashedpass2")
+		}
+		accessList[username] = hash
+	}
+	return accessList, nil
+}
+
+// parseAccessScopes parses the ACCESS_SCOPES environment variable in the user=scope,scope|user2=scope format.
+func parseAccessScopes(raw string) (map[string][]Scope, error) {
+	userScopes := make(map[string][]Scope)
+	for _, pair := range strings.Split(raw, "|") {
+		username, rawScopes, ok := strings.Cut(pair, "=")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid ACCESS_SCOPES format, expected user=scope,scope|user2=scope")
+		}
+		scopes, err := parseScopes(rawScopes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ACCESS_SCOPES for %s: %w", username, err)
+		}
+		userScopes[username] = scopes
+	}
+	return userScopes, nil
+}
+
+// readOnlyScopes are the default scopes of Basic auth and client certificate users with room access rules,
+// so that admin endpoints, which aren't limited to rooms, need to be granted explicitly.
+var readOnlyScopes = []Scope{ScopeMessagesRead, ScopeMediaRead}
+
+// userScopes returns the scopes of a Basic auth or client certificate user, nil for all scopes.
+func (ac *AuthConfig) userScopes(username string) []Scope {
+	if scopes, ok := ac.Scopes[username]; ok {
+		return scopes
+	} else if _, restricted := ac.AccessRules[username]; restricted {
+		return readOnlyScopes
+	}
+	return nil
+}
+
+func envString(name string, dest *string) {
+	if val := os.Getenv(name); val != "" {
+		*dest = val
+	}
+}
+
+func envInt(name string, dest *int) error {
+	if val := os.Getenv(name); val != "" {
+		parsed, err := strconv.Atoi(val)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, val)
+		}
+		*dest = parsed
+	}
+	return nil
+}
+
+func envFloat(name string, dest *float64) error {
+	if val := os.Getenv(name); val != "" {
+		parsed, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, val)
+		}
+		*dest = parsed
+	}
+	return nil
+}
+
+func envBool(name string, dest *bool) error {
+	if val := os.Getenv(name); val != "" {
+		parsed, err := strconv.ParseBool(val)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, val)
+		}
+		*dest = parsed
+	}
+	return nil
+}
+
+func envDuration(name string, dest *time.Duration) error {
+	if val := os.Getenv(name); val != "" {
+		parsed, err := time.ParseDuration(val)
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", name, val)
+		}
+		*dest = parsed
+	}
+	return nil
+}
+
+// Config returns the current configuration. It's replaced as a whole when the config is reloaded.
+func (ab *BeeperIngestor) Config() *IngestorConfig {
+	if cfg := ab.config.Load(); cfg != nil {
+		return cfg
+	}
+	return defaultIngestorConfig()
+}
+
+// applyConfig activates a validated config, rebuilding the authenticators and updating the limiters.
+// If it fails, the previous config stays active.
+func (ab *BeeperIngestor) applyConfig(ctx context.Context, cfg *IngestorConfig) error {
+	authenticators := make([]Authenticator, 0, 4)
+	if cfg.Listener.ClientCA != "" {
+		authenticators = append(authenticators, &clientCertAuthenticator{users: cfg.Listener.ClientCertUsers, auth: &cfg.Auth})
+	}
+	authenticators = append(authenticators, newBasicAuthenticator(&cfg.Auth))
+	if cfg.Auth.JWT != nil {
+		jwtAuth, err := newJWTAuthenticator(ctx, cfg.Auth.JWT)
+		if err != nil {
+			return fmt.Errorf("failed to initialize JWT authentication: %w", err)
+		}
+		authenticators = append(authenticators, jwtAuth)
+	}
+	authenticators = append(authenticators, &tokenAuthenticator{db: ab.db})
+
+	for username, hash := range cfg.Auth.AccessList {
+		if isLegacyPasswordHash(hash) {
+			ab.gmx.Log.Warn().
+				Str("username", username).
+				Msg("User has a legacy unsalted SHA-256 password hash, please rehash the password with `ingestor hash-password`")
+		}
+	}
+	ab.authenticators.Store(&authenticators)
+	ab.lockout.SetConfig(cfg.Auth.Lockout)
+	ab.rateLimiter.SetConfig(cfg.Limits.RateLimit)
+	ab.applyDeviceName(ctx, ab.config.Load(), cfg)
+	ab.config.Store(cfg)
+	return nil
+}
+
+// ReloadConfig loads the config file again and applies it. Listener and backfill settings
+// are only read at startup, so changes to them are ignored with a warning.
+func (ab *BeeperIngestor) ReloadConfig(ctx context.Context) error {
+	path, explicit := ingestorConfigPath(ab.gmx.ConfigDir)
+	cfg, err := loadIngestorConfig(path, explicit)
+	if err != nil {
+		return err
+	}
+	current := ab.Config()
+	if !reflect.DeepEqual(cfg.Listener, current.Listener) {
+		ab.gmx.Log.Warn().Msg("Listener settings changed, restart the ingestor to apply them")
+		cfg.Listener = current.Listener
+	}
+	if !reflect.DeepEqual(cfg.Backfill, current.Backfill) {
+		ab.gmx.Log.Warn().Msg("Backfill settings changed, restart the ingestor to apply them")
+		cfg.Backfill = current.Backfill
+	}
+	return ab.applyConfig(ctx, cfg)
+}
+
+// reloadConfigOnSIGHUP reloads the config whenever the process receives SIGHUP.
+func (ab *BeeperIngestor) reloadConfigOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		ab.gmx.Log.Info().Msg("Received SIGHUP, reloading config")
+		if err := ab.ReloadConfig(ab.gmx.Log.WithContext(context.Background())); err != nil {
+			ab.gmx.Log.Err(err).Msg("Failed to reload config, keeping the previous one")
+		} else {
+			ab.gmx.Log.Info().Msg("Config reloaded")
+		}
+	}
+}
+
+// endpoint wraps a handler so that it responds with 404 Not Found if the endpoint is disabled in the config.
+func (ab *BeeperIngestor) endpoint(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ab.Config().EndpointEnabled(name) {
+			writeError(w, r, errEndpointDisabled)
+			return
+		}
+		handler(w, r)
+	}
+}
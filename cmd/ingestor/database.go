@@ -0,0 +1,49 @@
+package main
+
+import (
+	"embed"
+
+	"go.mau.fi/util/dbutil"
+)
+
+//go:embed upgrades/*.sql
+var upgradesFS embed.FS
+
+var upgradeTable dbutil.UpgradeTable
+
+func init() {
+	upgradeTable.RegisterFSPath(upgradesFS, "upgrades")
+}
+
+// IngestorDatabase contains the tables owned by the ingestor itself.
+// They live in the gomuks database next to the hicli tables, with a separate version table.
+type IngestorDatabase struct {
+	*dbutil.Database
+
+	Backfill BackfillProgressQuery
+	Token    APITokenQuery
+	Audit    AuditQuery
+}
+
+func newIngestorDatabase(parent *dbutil.Database) *IngestorDatabase {
+	db := parent.Child("ingestor_version", upgradeTable, nil)
+	return &IngestorDatabase{
+		Database: db,
+
+		Backfill: BackfillProgressQuery{QueryHelper: dbutil.MakeQueryHelper(db, newBackfillProgress)},
+		Token:    APITokenQuery{QueryHelper: dbutil.MakeQueryHelper(db, newAPIToken)},
+		Audit:    AuditQuery{QueryHelper: dbutil.MakeQueryHelper(db, newAuditEntry)},
+	}
+}
+
+func newBackfillProgress(_ *dbutil.QueryHelper[*BackfillProgress]) *BackfillProgress {
+	return &BackfillProgress{}
+}
+
+func newAPIToken(_ *dbutil.QueryHelper[*APIToken]) *APIToken {
+	return &APIToken{}
+}
+
+func newAuditEntry(_ *dbutil.QueryHelper[*AuditEntry]) *AuditEntry {
+	return &AuditEntry{}
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+const (
+	// Encrypted events that failed to decrypt, grouped by megolm session.
+	// last_error is the error of the newest event of the session.
+	getDecryptionFailuresBaseQuery = `
+		SELECT room_id, COALESCE(megolm_session_id, ''), COUNT(*), MIN(timestamp), MAX(timestamp),
+		       (SELECT newest.decryption_error FROM event newest
+		        WHERE newest.room_id = event.room_id AND newest.megolm_session_id IS event.megolm_session_id
+		          AND newest.decryption_error IS NOT NULL AND newest.decrypted IS NULL
+		        ORDER BY newest.timestamp DESC LIMIT 1)
+		FROM event
+		WHERE decryption_error IS NOT NULL AND decrypted IS NULL
+	`
+	getDecryptionFailuresQuery     = getDecryptionFailuresBaseQuery + `GROUP BY room_id, megolm_session_id ORDER BY room_id, MAX(timestamp) DESC`
+	getRoomDecryptionFailuresQuery = getDecryptionFailuresBaseQuery + `AND room_id = $1 GROUP BY megolm_session_id ORDER BY MAX(timestamp) DESC`
+	getFailedMegolmSessionsQuery   = `
+		SELECT DISTINCT room_id, megolm_session_id FROM event
+		WHERE decryption_error IS NOT NULL AND decrypted IS NULL AND megolm_session_id IS NOT NULL
+	`
+)
+
+const (
+	// decryptionRetryInterval is how often the retrier goes through all sessions of events that failed to decrypt.
+	decryptionRetryInterval = time.Hour
+	// decryptionRetryDelay is how long the retrier waits after a session is received before checking it again.
+	decryptionRetryDelay = 10 * time.Second
+	// decryptionRetryMaxSessions is the maximum number of sessions to retry per pass, the rest wait for the next one.
+	decryptionRetryMaxSessions = 1000
+)
+
+type DecryptionFailureQuery struct {
+	*dbutil.QueryHelper[*SessionDecryptionFailures]
+}
+
+// GetAll returns the decryption failures grouped by room and session, optionally only in one room.
+func (dfq *DecryptionFailureQuery) GetAll(ctx context.Context, roomID id.RoomID) ([]*SessionDecryptionFailures, error) {
+	if roomID != "" {
+		return dfq.QueryMany(ctx, getRoomDecryptionFailuresQuery, roomID)
+	}
+	return dfq.QueryMany(ctx, getDecryptionFailuresQuery)
+}
+
+// SessionDecryptionFailures is a group of stored events that failed to decrypt because of the same megolm session.
+type SessionDecryptionFailures struct {
+	RoomID id.RoomID `json:"-"`
+	// SessionID is empty for events that don't have a megolm session ID, e.g. because they're not megolm encrypted.
+	SessionID       id.SessionID       `json:"session_id"`
+	EventCount      int                `json:"event_count"`
+	OldestTimestamp jsontime.UnixMilli `json:"oldest_timestamp"`
+	NewestTimestamp jsontime.UnixMilli `json:"newest_timestamp"`
+	LastError       string             `json:"last_error"`
+	// SessionKnown is true if the ingestor has the session now, so the events fail for another reason,
+	// such as the session not starting early enough.
+	SessionKnown bool `json:"session_known"`
+}
+
+func (sdf *SessionDecryptionFailures) Scan(row dbutil.Scannable) (*SessionDecryptionFailures, error) {
+	var lastError sql.NullString
+	err := row.Scan(&sdf.RoomID, &sdf.SessionID, &sdf.EventCount, &sdf.OldestTimestamp, &sdf.NewestTimestamp, &lastError)
+	if err != nil {
+		return nil, err
+	}
+	sdf.LastError = lastError.String
+	return sdf, nil
+}
+
+func newSessionDecryptionFailures(_ *dbutil.QueryHelper[*SessionDecryptionFailures]) *SessionDecryptionFailures {
+	return &SessionDecryptionFailures{}
+}
+
+type roomSession struct {
+	RoomID    id.RoomID
+	SessionID id.SessionID
+}
+
+// DecryptionRetrier retries decryption of stored events when the megolm sessions they need arrive.
+//
+// hicli already retries the events of a session when it's received, but only the events that are in the database at
+// that moment, and it doesn't try again if that fails. The retrier checks the session again after a short delay
+// to catch events that were being stored at the same time, e.g. by backfill, and periodically goes through all
+// failed sessions to catch sessions that were imported by other processes such as `ingestor verify`.
+type DecryptionRetrier struct {
+	h        *hicli.HiClient
+	log      zerolog.Logger
+	failures DecryptionFailureQuery
+	// retrySession is hicli's session received callback, which retries decryption of the events of a session.
+	retrySession func(ctx context.Context, roomID id.RoomID, sessionID id.SessionID, firstKnownIndex uint32)
+
+	lock sync.Mutex
+	// pending are sessions that were received since the last retry.
+	pending map[roomSession]struct{}
+	// attempted is the first known index of each session when decryption was last retried with it.
+	attempted map[roomSession]uint32
+	wakeup    chan struct{}
+	stop      context.CancelFunc
+	stopped   chan struct{}
+}
+
+// newDecryptionRetrier creates a retrier and hooks it into the session received callback of the client.
+// It must be created before the client is started so that it doesn't miss sessions from the first sync.
+func newDecryptionRetrier(h *hicli.HiClient, log zerolog.Logger) *DecryptionRetrier {
+	dr := &DecryptionRetrier{
+		h:            h,
+		log:          log,
+		failures:     DecryptionFailureQuery{QueryHelper: dbutil.MakeQueryHelper(h.DB.Database, newSessionDecryptionFailures)},
+		retrySession: h.Crypto.SessionReceived,
+		pending:      make(map[roomSession]struct{}),
+		attempted:    make(map[roomSession]uint32),
+		wakeup:       make(chan struct{}, 1),
+		stopped:      make(chan struct{}),
+	}
+	h.Crypto.SessionReceived = func(ctx context.Context, roomID id.RoomID, sessionID id.SessionID, firstKnownIndex uint32) {
+		dr.retrySession(ctx, roomID, sessionID, firstKnownIndex)
+		dr.lock.Lock()
+		dr.pending[roomSession{roomID, sessionID}] = struct{}{}
+		dr.lock.Unlock()
+		select {
+		case dr.wakeup <- struct{}{}:
+		default:
+		}
+	}
+	return dr
+}
+
+// Start runs the retrier in a background goroutine.
+func (dr *DecryptionRetrier) Start() {
+	var ctx context.Context
+	ctx, dr.stop = context.WithCancel(dr.log.WithContext(context.Background()))
+	go dr.run(ctx)
+}
+
+// Stop stops the retrier and waits for the current retry to finish.
+func (dr *DecryptionRetrier) Stop() {
+	if dr.stop != nil {
+		dr.stop()
+		<-dr.stopped
+	}
+}
+
+func (dr *DecryptionRetrier) run(ctx context.Context) {
+	defer close(dr.stopped)
+	dr.retryFailedSessions(ctx)
+	ticker := time.NewTicker(decryptionRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-dr.wakeup:
+			// Give transactions that were storing events of the sessions time to commit
+			select {
+			case <-time.After(decryptionRetryDelay):
+			case <-ctx.Done():
+				return
+			}
+			dr.lock.Lock()
+			pending := dr.pending
+			dr.pending = make(map[roomSession]struct{})
+			dr.lock.Unlock()
+			for session := range pending {
+				dr.retry(ctx, session, true)
+			}
+		case <-ticker.C:
+			dr.retryFailedSessions(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// retryFailedSessions retries decryption of failed events whose sessions the ingestor has now.
+func (dr *DecryptionRetrier) retryFailedSessions(ctx context.Context) {
+	rows, err := dr.h.DB.Query(ctx, getFailedMegolmSessionsQuery)
+	sessions, err := dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (rs roomSession, err error) {
+		err = row.Scan(&rs.RoomID, &rs.SessionID)
+		return
+	}, err).AsList()
+	if err != nil {
+		dr.log.Err(err).Msg("Failed to get sessions of events that failed to decrypt")
+		return
+	}
+	var retried int
+	for _, session := range sessions {
+		if ctx.Err() != nil || retried >= decryptionRetryMaxSessions {
+			break
+		} else if dr.retry(ctx, session, false) {
+			retried++
+		}
+	}
+	if retried > 0 {
+		dr.log.Debug().Int("failed_sessions", len(sessions)).Int("retried", retried).Msg("Retried decryption of failed events")
+	}
+}
+
+// retry retries decryption with a session if the ingestor has it. Unless force is set, the session is skipped if
+// decryption was already retried with it and it hasn't been replaced with one that starts from an earlier index.
+func (dr *DecryptionRetrier) retry(ctx context.Context, session roomSession, force bool) bool {
+	igs, err := dr.h.CryptoStore.GetGroupSession(ctx, session.RoomID, session.SessionID)
+	if err != nil {
+		dr.log.Warn().Err(err).
+			Stringer("room_id", session.RoomID).
+			Stringer("session_id", session.SessionID).
+			Msg("Failed to get megolm session to retry decryption")
+		return false
+	} else if igs == nil {
+		return false
+	}
+	firstKnownIndex := igs.Internal.FirstKnownIndex()
+	dr.lock.Lock()
+	prevIndex, alreadyAttempted := dr.attempted[session]
+	dr.attempted[session] = firstKnownIndex
+	dr.lock.Unlock()
+	if !force && alreadyAttempted && prevIndex <= firstKnownIndex {
+		return false
+	}
+	dr.retrySession(ctx, session.RoomID, session.SessionID, firstKnownIndex)
+	return true
+}
+
+// SessionKnown checks if the ingestor has a megolm session.
+func (dr *DecryptionRetrier) SessionKnown(ctx context.Context, roomID id.RoomID, sessionID id.SessionID) bool {
+	igs, err := dr.h.CryptoStore.GetGroupSession(ctx, roomID, sessionID)
+	return err == nil && igs != nil
+}
+
+// DecryptionFailuresResponse is the response of the decryption failure report.
+type DecryptionFailuresResponse struct {
+	EventCount int                       `json:"event_count"`
+	Rooms      []*RoomDecryptionFailures `json:"rooms"`
+}
+
+// RoomDecryptionFailures are the events that failed to decrypt in one room.
+type RoomDecryptionFailures struct {
+	RoomID     id.RoomID                    `json:"room_id"`
+	Name       string                       `json:"name,omitempty"`
+	EventCount int                          `json:"event_count"`
+	Sessions   []*SessionDecryptionFailures `json:"sessions"`
+}
+
+// GetDecryptionFailures reports the stored events that couldn't be decrypted, grouped by room and megolm session.
+func (ab *BeeperIngestor) GetDecryptionFailures(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	}
+	roomID := id.RoomID(r.URL.Query().Get("room_id"))
+	if roomID != "" && !roomFilter.Allows(roomID) {
+		writeError(w, r, errNoSuchRoom("room_id"))
+		return
+	}
+	failures, err := ab.decryption.failures.GetAll(r.Context(), roomID)
+	if err != nil {
+		log.Err(err).Msg("Failed to get decryption failures")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get decryption failures"))
+		return
+	}
+	resp := &DecryptionFailuresResponse{Rooms: []*RoomDecryptionFailures{}}
+	var room *RoomDecryptionFailures
+	for _, failure := range failures {
+		if !roomFilter.Allows(failure.RoomID) {
+			continue
+		}
+		if room == nil || room.RoomID != failure.RoomID {
+			room = &RoomDecryptionFailures{RoomID: failure.RoomID}
+			if info, err := ab.gmx.Client.DB.Room.Get(r.Context(), failure.RoomID); err != nil {
+				log.Warn().Err(err).Stringer("room_id", failure.RoomID).Msg("Failed to get room info")
+			} else if info != nil && info.Name != nil {
+				room.Name = *info.Name
+			}
+			resp.Rooms = append(resp.Rooms, room)
+		}
+		if failure.SessionID != "" {
+			failure.SessionKnown = ab.decryption.SessionKnown(r.Context(), failure.RoomID, failure.SessionID)
+		}
+		room.Sessions = append(room.Sessions, failure)
+		room.EventCount += failure.EventCount
+		resp.EventCount += failure.EventCount
+	}
+
+	audit := auditEntryFromContext(r.Context())
+	for _, room := range resp.Rooms {
+		audit.AddRooms(room.RoomID)
+	}
+	audit.SetResultCount(resp.EventCount)
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Err(err).Msg("Failed to encode response")
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// defaultDeviceName is the display name of new devices if device.name isn't set.
+const defaultDeviceName = "gomuks web"
+
+// DeviceConfig controls the ingestor's Matrix device.
+type DeviceConfig struct {
+	// Name is the display name of the device in the device lists of the account. New logins use it, and the
+	// existing device is renamed at startup and on reload if it's set. If it's empty, new logins use
+	// defaultDeviceName and the existing device keeps its name.
+	Name string `yaml:"name"`
+}
+
+// DisplayName returns the display name for new logins.
+func (cfg *DeviceConfig) DisplayName() string {
+	if cfg.Name != "" {
+		return cfg.Name
+	}
+	return defaultDeviceName
+}
+
+// MeResponse describes the ingestor's account and the encryption health of its device.
+type MeResponse struct {
+	UserID     id.UserID   `json:"user_id"`
+	DeviceID   id.DeviceID `json:"device_id"`
+	DeviceName string      `json:"device_name"`
+	// Verified is true if the device is signed by the account's self-signing key. Unverified devices don't sync.
+	Verified     bool               `json:"verified"`
+	CrossSigning CrossSigningStatus `json:"cross_signing"`
+	KeyBackup    KeyBackupStatus    `json:"key_backup"`
+	OneTimeKeys  OneTimeKeyCounts   `json:"one_time_keys"`
+}
+
+// CrossSigningStatus describes the cross-signing keys of the account.
+type CrossSigningStatus struct {
+	// MasterKey is the public master key of the account, empty if the ingestor doesn't know of one.
+	MasterKey id.Ed25519 `json:"master_key"`
+	// HasPrivateKeys is true if the ingestor has the private cross-signing keys from secret storage.
+	HasPrivateKeys bool `json:"has_private_keys"`
+}
+
+// KeyBackupStatus describes the server-side key backup of the account.
+type KeyBackupStatus struct {
+	// Version is the latest key backup version on the server, empty if the account has no key backup.
+	Version id.KeyBackupVersion `json:"version"`
+	// Enabled is true if the ingestor has the key of the latest version, so that it can restore sessions from it.
+	Enabled bool `json:"enabled"`
+}
+
+// OneTimeKeyCounts is the number of unclaimed one-time keys of the device on the server. Other devices claim one
+// to start an Olm session, so a device without any can't receive room keys from devices it hasn't talked to yet.
+type OneTimeKeyCounts struct {
+	SignedCurve25519 int `json:"signed_curve25519"`
+}
+
+// verificationState is a copy of the parts of the client that VerifyDevice changes.
+type verificationState struct {
+	Verified            bool
+	HasCrossSigningKeys bool
+	HasKeyBackupKey     bool
+	KeyBackupVersion    id.KeyBackupVersion
+}
+
+// verificationState copies the verification state of the client under the read lock. Requests must not hold
+// the lock while they call the homeserver, because a waiting VerifyDevice would then block /readyz too.
+func (ab *BeeperIngestor) verificationState(h *hicli.HiClient) verificationState {
+	ab.verifyLock.RLock()
+	defer ab.verifyLock.RUnlock()
+	return verificationState{
+		Verified:            h.Verified,
+		HasCrossSigningKeys: h.Crypto.CrossSigningKeys != nil,
+		HasKeyBackupKey:     h.KeyBackupKey != nil,
+		KeyBackupVersion:    h.KeyBackupVersion,
+	}
+}
+
+// getMe collects the account and device status. The device name, key backup and one-time key counts are
+// fetched from the homeserver, the rest comes from the crypto store and the given verification state.
+func getMe(ctx context.Context, h *hicli.HiClient, state verificationState) (*MeResponse, error) {
+	resp := &MeResponse{
+		UserID:   h.Account.UserID,
+		DeviceID: h.Account.DeviceID,
+		Verified: state.Verified,
+		CrossSigning: CrossSigningStatus{
+			HasPrivateKeys: state.HasCrossSigningKeys,
+		},
+	}
+	if keys := h.Crypto.GetOwnCrossSigningPublicKeys(ctx); keys != nil {
+		resp.CrossSigning.MasterKey = keys.MasterKey
+	}
+	device, err := h.Client.GetDeviceInfo(ctx, h.Account.DeviceID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get device info: %w", err)
+	}
+	resp.DeviceName = device.DisplayName
+	versionInfo, err := h.Client.GetKeyBackupLatestVersion(ctx)
+	if errors.Is(err, mautrix.MNotFound) {
+		// The account has no key backup
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get latest key backup version: %w", err)
+	} else {
+		resp.KeyBackup.Version = versionInfo.Version
+		resp.KeyBackup.Enabled = state.HasKeyBackupKey && state.KeyBackupVersion == versionInfo.Version
+	}
+	// Uploading nothing is the only way to ask for the counts outside of sync.
+	otkResp, err := h.Client.UploadKeys(ctx, &mautrix.ReqUploadKeys{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get one-time key counts: %w", err)
+	}
+	resp.OneTimeKeys.SignedCurve25519 = otkResp.OneTimeKeyCounts.SignedCurve25519
+	return resp, nil
+}
+
+// setDeviceName renames the ingestor's device if its display name on the server is different.
+func setDeviceName(ctx context.Context, h *hicli.HiClient, name string) error {
+	device, err := h.Client.GetDeviceInfo(ctx, h.Account.DeviceID)
+	if err != nil {
+		return fmt.Errorf("failed to get device info: %w", err)
+	} else if device.DisplayName == name {
+		return nil
+	}
+	err = h.Client.SetDeviceInfo(ctx, h.Account.DeviceID, &mautrix.ReqDeviceInfo{DisplayName: name})
+	if err != nil {
+		return fmt.Errorf("failed to set device name: %w", err)
+	}
+	zerolog.Ctx(ctx).Info().
+		Str("old_name", device.DisplayName).
+		Str("new_name", name).
+		Msg("Renamed device")
+	return nil
+}
+
+// applyDeviceName renames the device in the background if device.name is set and changed from the previous config,
+// so that an unreachable homeserver doesn't block startup or reloads.
+func (ab *BeeperIngestor) applyDeviceName(ctx context.Context, previous, cfg *IngestorConfig) {
+	h := ab.gmx.Client
+	name := cfg.Device.Name
+	if name == "" || (previous != nil && previous.Device.Name == name) || h == nil || !h.IsLoggedIn() {
+		return
+	}
+	go func() {
+		if err := setDeviceName(ctx, h, name); err != nil {
+			zerolog.Ctx(ctx).Err(err).Msg("Failed to apply device name")
+		}
+	}()
+}
+
+// GetMe returns the logged-in account, the device and its encryption status, for monitoring.
+func (ab *BeeperIngestor) GetMe(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	h, ok := ab.loggedInClient(w, r)
+	if !ok {
+		return
+	}
+	resp, err := getMe(r.Context(), h, ab.verificationState(h))
+	if err != nil {
+		log.Err(err).Msg("Failed to get account status")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get account status: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Err(err).Msg("Failed to encode response")
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"maunium.net/go/mautrix"
+)
+
+// Errors use the Matrix error format, so that the standard error codes from the mautrix package can be used:
+//
+//	{"errcode": "M_INVALID_PARAM", "error": "Invalid limit parameter", "param": "limit", "request_id": "..."}
+//
+// The request ID is always included, so that errors reported by users can be found in the logs and audit log.
+var (
+	// errEndpointDisabled is returned for endpoints that are disabled in the config.
+	errEndpointDisabled = mautrix.RespError{ErrCode: "M_UNRECOGNIZED", StatusCode: http.StatusNotFound, Err: "Endpoint is disabled"}
+	// errMethodNotAllowed is returned when a route exists, but not with the request method.
+	errMethodNotAllowed = mautrix.RespError{ErrCode: "M_UNRECOGNIZED", StatusCode: http.StatusMethodNotAllowed, Err: "Method not allowed"}
+)
+
+// withExtra returns a copy of the error with an extra field in the response.
+func withExtra(err mautrix.RespError, key string, value any) mautrix.RespError {
+	err.ExtraData = maps.Clone(err.ExtraData)
+	if err.ExtraData == nil {
+		err.ExtraData = make(map[string]any)
+	}
+	err.ExtraData[key] = value
+	return err
+}
+
+// errInvalidParam is an M_INVALID_PARAM error naming the query or path parameter that was invalid.
+func errInvalidParam(param, msg string, args ...any) mautrix.RespError {
+	return withExtra(mautrix.MInvalidParam.WithMessage(msg, args...), "param", param)
+}
+
+// errNoSuchRoom is an M_NOT_FOUND error for rooms that don't exist or that the API user can't access.
+func errNoSuchRoom(param string) mautrix.RespError {
+	return withExtra(mautrix.MNotFound.WithMessage("Room not found"), "param", param)
+}
+
+// errRetryAfter is an M_LIMIT_EXCEEDED error with a retry hint in milliseconds, like Matrix homeservers use.
+// The Retry-After header is set too.
+func errRetryAfter(w http.ResponseWriter, msg string, retryAfter time.Duration) mautrix.RespError {
+	w.Header().Set("Retry-After", ceilSeconds(retryAfter))
+	return withExtra(mautrix.MLimitExceeded.WithMessage(msg), "retry_after_ms", retryAfter.Milliseconds())
+}
+
+// writeError writes a JSON error response with the ID of the request.
+func writeError(w http.ResponseWriter, r *http.Request, err mautrix.RespError) {
+	if requestID, ok := hlog.IDFromRequest(r); ok {
+		err = withExtra(err, "request_id", requestID.String())
+	}
+	statusCode := err.StatusCode
+	if statusCode == 0 {
+		statusCode = http.StatusInternalServerError
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	_ = json.NewEncoder(w).Encode(&err)
+}
+
+// jsonRouterErrors replaces the plain text 404 and 405 responses of the router with JSON errors.
+func jsonRouterErrors(router *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := router.Handler(r); pattern != "" {
+			router.ServeHTTP(w, r)
+			return
+		}
+		// The router sets the Allow header if the path exists with other methods
+		rec := &unmatchedRouteWriter{ResponseWriter: w}
+		router.ServeHTTP(rec, r)
+		if rec.Header().Get("Allow") != "" {
+			writeError(w, r, errMethodNotAllowed)
+		} else {
+			writeError(w, r, mautrix.MUnrecognized.WithMessage("Unrecognized endpoint"))
+		}
+	})
+}
+
+// unmatchedRouteWriter discards the response of the router, but keeps the headers it sets.
+type unmatchedRouteWriter struct {
+	http.ResponseWriter
+}
+
+func (urw *unmatchedRouteWriter) WriteHeader(int) {}
+
+func (urw *unmatchedRouteWriter) Write(data []byte) (int, error) {
+	return len(data), nil
+}
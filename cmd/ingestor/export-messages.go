@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+// exportBatchSize is how many events are read from the database at a time while streaming an export.
+const exportBatchSize = 500
+
+// ExportMessagesQuery is a keyset cursor for reading a room's messages in chronological order
+type ExportMessagesQuery struct {
+	RoomID     id.RoomID
+	AfterTS    int64
+	AfterRowID database.EventRowID
+	Limit      int
+}
+
+// ExportMessagesDatabaseQuery returns the next batch of messages in a room after the given (timestamp, rowid) position
+func (ab *BeeperIngestor) ExportMessagesDatabaseQuery(ctx context.Context, params ExportMessagesQuery) ([]*database.Event, error) {
+	query := messageEventBaseQuery + `
+		WHERE ` + messageEventCondition + `
+		  AND event.room_id = $1
+		  AND (event.timestamp, event.rowid) > ($2, $3)
+		ORDER BY event.timestamp ASC, event.rowid ASC
+		LIMIT $4`
+	return ab.gmx.Client.DB.Event.QueryHelper.QueryMany(ctx, query, params.RoomID, params.AfterTS, params.AfterRowID, params.Limit)
+}
+
+// ExportRoom streams the full history of a room as newline-delimited Message objects.
+//
+// Events are read from the database in small batches and flushed to the client after each batch,
+// so memory usage stays constant regardless of the size of the room.
+func (ab *BeeperIngestor) ExportRoom(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	roomID := id.RoomID(r.PathValue("roomID"))
+
+	switch r.URL.Query().Get("format") {
+	case "", "ndjson":
+	default:
+		writeError(w, r, errInvalidParam("format", "Invalid format parameter, must be 'ndjson'"))
+		return
+	}
+
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	} else if !roomFilter.Allows(roomID) {
+		writeError(w, r, errNoSuchRoom("roomID"))
+		return
+	}
+
+	room, err := ab.gmx.Client.DB.Room.Get(r.Context(), roomID)
+	if err != nil {
+		log.Err(err).Str("room_id", roomID.String()).Msg("Failed to get room info")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get room info"))
+		return
+	} else if room == nil {
+		writeError(w, r, errNoSuchRoom("roomID"))
+		return
+	}
+
+	audit := auditEntryFromContext(r.Context())
+	audit.AddRooms(roomID)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	encoder := json.NewEncoder(w)
+
+	params := ExportMessagesQuery{
+		RoomID: roomID,
+		Limit:  exportBatchSize,
+	}
+	exported := 0
+	for {
+		events, err := ab.ExportMessagesDatabaseQuery(r.Context(), params)
+		if err != nil {
+			// Headers have already been sent, so the best we can do is cut the stream short
+			log.Err(err).Int("exported", exported).Msg("Failed to query timeline for export")
+			return
+		}
+		for _, event := range events {
+			if err = encoder.Encode(ab.eventToMessage(event, room)); err != nil {
+				log.Err(err).Int("exported", exported).Msg("Failed to write export")
+				return
+			}
+			exported++
+		}
+		audit.SetResultCount(exported)
+		if err = rc.Flush(); err != nil {
+			log.Err(err).Int("exported", exported).Msg("Failed to flush export")
+			return
+		}
+		if len(events) < params.Limit {
+			break
+		}
+		last := events[len(events)-1]
+		params.AfterTS = last.Timestamp.UnixMilli()
+		params.AfterRowID = last.RowID
+	}
+	log.Debug().Str("room_id", roomID.String()).Int("exported", exported).Msg("Finished room export")
+}
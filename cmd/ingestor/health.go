@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// ReadinessConfig controls when /readyz reports the ingestor as ready.
+type ReadinessConfig struct {
+	// MaxSyncAge is how long ago the last successful sync can be before the ingestor is considered stale.
+	MaxSyncAge time.Duration `yaml:"max_sync_age"`
+}
+
+func (cfg *ReadinessConfig) applyEnv() error {
+	return envDuration("READINESS_MAX_SYNC_AGE", &cfg.MaxSyncAge)
+}
+
+func (cfg *ReadinessConfig) validate() error {
+	if cfg.MaxSyncAge <= 0 {
+		return fmt.Errorf("max_sync_age must be positive")
+	}
+	return nil
+}
+
+// readinessDBTimeout is how long the database check of /readyz can take.
+const readinessDBTimeout = 2 * time.Second
+
+// ReadinessCheck is the result of one readiness condition.
+type ReadinessCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// ReadinessResponse is the response of /readyz.
+type ReadinessResponse struct {
+	Ready bool `json:"ready"`
+	// LastSync is the time of the last successful sync, omitted if there hasn't been one.
+	LastSync *time.Time                `json:"last_sync,omitempty"`
+	Checks   map[string]ReadinessCheck `json:"checks"`
+}
+
+// Healthz reports that the process is up and serving requests.
+func (ab *BeeperIngestor) Healthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write([]byte(`{"status":"ok"}`))
+}
+
+// Readyz reports whether the ingestor is logged in, synced and able to serve fresh data.
+// It responds with 503 Service Unavailable if any check fails.
+func (ab *BeeperIngestor) Readyz(w http.ResponseWriter, r *http.Request) {
+	h := ab.gmx.Client
+	resp := &ReadinessResponse{Checks: make(map[string]ReadinessCheck)}
+	check := func(name string, ok bool, detail string) {
+		resp.Checks[name] = ReadinessCheck{OK: ok, Detail: detail}
+	}
+
+	check("logged_in", h.IsLoggedIn(), "")
+	verification := ab.verificationState(h)
+	check("e2ee_keys_loaded", verification.Verified && verification.HasCrossSigningKeys && verification.HasKeyBackupKey, "")
+	lastSync := ab.syncMonitor.LastSuccess()
+	if lastSync.IsZero() {
+		check("initial_sync", false, "no successful sync yet")
+		check("sync_fresh", false, "no successful sync yet")
+	} else {
+		resp.LastSync = &lastSync
+		check("initial_sync", true, "")
+		age := time.Since(lastSync).Truncate(time.Second)
+		maxAge := ab.Config().Readiness.MaxSyncAge
+		if age > maxAge {
+			check("sync_fresh", false, fmt.Sprintf("last sync was %s ago, more than %s", age, maxAge))
+		} else {
+			check("sync_fresh", true, fmt.Sprintf("last sync was %s ago", age))
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), readinessDBTimeout)
+	defer cancel()
+	var one int
+	if err := ab.db.QueryRow(ctx, "SELECT 1").Scan(&one); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Readiness database check failed")
+		check("database", false, "database query failed")
+	} else {
+		check("database", true, "")
+	}
+
+	resp.Ready = true
+	for _, result := range resp.Checks {
+		resp.Ready = resp.Ready && result.OK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to encode readiness response")
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/tidwall/sjson"
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// importBatchSize is how many events are inserted in a single database transaction while importing.
+const importBatchSize = 500
+
+// importUnsignedKey is the key in the unsigned data of an event that marks it as imported from a file.
+const importUnsignedKey = "com.beeper.ingestor.import"
+
+// ImportMetadata is stored under importUnsignedKey in the unsigned data of every imported event.
+type ImportMetadata struct {
+	Source     string             `json:"source"`
+	ImportedAt jsontime.UnixMilli `json:"imported_at"`
+}
+
+// ImportStats counts what happened to the events in an import.
+type ImportStats struct {
+	Imported      int
+	Duplicate     int
+	Invalid       int
+	Undecryptable int
+}
+
+// eventImporter loads events from Element "Export chat" JSON files or raw Matrix event dumps into the gomuks database.
+//
+// The supported file layouts are:
+//   - Element exports: an object with the events in "messages" (and the room name in "room_name")
+//   - /messages responses or similar: an object with the events in "chunk"
+//   - a JSON array of events
+//   - newline-delimited events (or any other sequence of the above)
+type eventImporter struct {
+	client *hicli.HiClient
+	log    zerolog.Logger
+
+	// RoomID is used for events that don't have a room_id, which Element omits in some export versions.
+	RoomID id.RoomID
+	// Decrypt controls whether encrypted events are decrypted with the keys of the logged-in account.
+	Decrypt bool
+
+	importedAt   jsontime.UnixMilli
+	source       string
+	roomName     string
+	knownRooms   map[id.RoomID]bool
+	createdRooms map[id.RoomID]struct{}
+	batch        []*event.Event
+	stats        ImportStats
+}
+
+func newEventImporter(client *hicli.HiClient, log zerolog.Logger) *eventImporter {
+	return &eventImporter{
+		client:     client,
+		log:        log,
+		importedAt: jsontime.UM(time.Now()),
+		knownRooms: make(map[id.RoomID]bool),
+	}
+}
+
+// ImportFile imports all events in the given file and returns the counts for that file.
+func (imp *eventImporter) ImportFile(ctx context.Context, path string) (ImportStats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return ImportStats{}, err
+	}
+	defer file.Close()
+	imp.source = filepath.Base(path)
+	imp.roomName = ""
+	imp.createdRooms = make(map[id.RoomID]struct{})
+	imp.stats = ImportStats{}
+
+	dec := json.NewDecoder(bufio.NewReader(file))
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return imp.stats, fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+		switch tok {
+		case json.Delim('['):
+			err = imp.readEventArray(ctx, dec)
+		case json.Delim('{'):
+			err = imp.readObject(ctx, dec)
+		default:
+			err = fmt.Errorf("unexpected %v at offset %d", tok, dec.InputOffset())
+		}
+		if err != nil {
+			return imp.stats, fmt.Errorf("failed to import %s: %w", path, err)
+		}
+	}
+	if err = imp.flush(ctx); err != nil {
+		return imp.stats, fmt.Errorf("failed to import %s: %w", path, err)
+	}
+	if err = imp.nameCreatedRooms(ctx); err != nil {
+		return imp.stats, err
+	}
+	return imp.stats, nil
+}
+
+// readEventArray reads the remaining items of an array whose opening bracket has already been consumed.
+func (imp *eventImporter) readEventArray(ctx context.Context, dec *json.Decoder) error {
+	for dec.More() {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return err
+		} else if err = imp.addEvent(ctx, raw); err != nil {
+			return err
+		}
+	}
+	_, err := dec.Token()
+	return err
+}
+
+// readObject reads an object whose opening brace has already been consumed.
+// Objects with a "messages" or "chunk" array are treated as export wrappers, anything else as a single event.
+func (imp *eventImporter) readObject(ctx context.Context, dec *json.Decoder) error {
+	fields := make(map[string]json.RawMessage)
+	isWrapper := false
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if key == "messages" || key == "chunk" {
+			if tok, err = dec.Token(); err != nil {
+				return err
+			} else if tok != json.Delim('[') {
+				return fmt.Errorf("expected %q to be an array", key)
+			} else if err = imp.readEventArray(ctx, dec); err != nil {
+				return err
+			}
+			isWrapper = true
+			continue
+		}
+		var value json.RawMessage
+		if err = dec.Decode(&value); err != nil {
+			return err
+		}
+		fields[key] = value
+	}
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	if isWrapper {
+		_ = json.Unmarshal(fields["room_name"], &imp.roomName)
+		return nil
+	}
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	return imp.addEvent(ctx, raw)
+}
+
+func (imp *eventImporter) addEvent(ctx context.Context, raw json.RawMessage) error {
+	var evt event.Event
+	if err := json.Unmarshal(raw, &evt); err != nil {
+		imp.log.Debug().Err(err).Msg("Skipping unparseable event")
+		imp.stats.Invalid++
+		return nil
+	}
+	if evt.RoomID == "" {
+		evt.RoomID = imp.RoomID
+	}
+	if evt.ID == "" || evt.RoomID == "" || evt.Sender == "" || evt.Type.Type == "" {
+		imp.stats.Invalid++
+		return nil
+	}
+	if evt.StateKey != nil {
+		evt.Type.Class = event.StateEventType
+	} else {
+		evt.Type.Class = event.MessageEventType
+	}
+	imp.batch = append(imp.batch, &evt)
+	if len(imp.batch) >= importBatchSize {
+		return imp.flush(ctx)
+	}
+	return nil
+}
+
+// flush inserts the pending events in a single transaction, skipping ones that are already in the database.
+func (imp *eventImporter) flush(ctx context.Context) error {
+	if len(imp.batch) == 0 {
+		return nil
+	}
+	metadata := &ImportMetadata{Source: imp.source, ImportedAt: imp.importedAt}
+	err := imp.client.DB.DoTxn(ctx, nil, func(ctx context.Context) error {
+		for _, evt := range imp.batch {
+			existing, err := imp.client.DB.Event.GetByID(ctx, evt.ID)
+			if err != nil {
+				return fmt.Errorf("failed to check if event %s exists: %w", evt.ID, err)
+			} else if existing != nil {
+				imp.stats.Duplicate++
+				continue
+			}
+			if err = imp.ensureRoom(ctx, evt.RoomID); err != nil {
+				return err
+			}
+			dbEvt := database.MautrixToEvent(evt)
+			dbEvt.Reactions = make(map[string]int)
+			if evt.Type == event.EventEncrypted && dbEvt.RedactedBy == "" {
+				imp.decryptEvent(ctx, evt, dbEvt)
+			}
+			dbEvt.Unsigned, err = sjson.SetBytes(dbEvt.Unsigned, strings.ReplaceAll(importUnsignedKey, ".", `\.`), metadata)
+			if err != nil {
+				return fmt.Errorf("failed to mark event %s as imported: %w", evt.ID, err)
+			}
+			if _, err = imp.client.DB.Event.Insert(ctx, dbEvt); err != nil {
+				return fmt.Errorf("failed to insert event %s: %w", evt.ID, err)
+			}
+			imp.stats.Imported++
+		}
+		return nil
+	})
+	imp.batch = imp.batch[:0]
+	return err
+}
+
+func (imp *eventImporter) decryptEvent(ctx context.Context, evt *event.Event, dbEvt *database.Event) {
+	if !imp.Decrypt {
+		dbEvt.DecryptionError = "imported without an account to decrypt with"
+		imp.stats.Undecryptable++
+		return
+	}
+	err := evt.Content.ParseRaw(evt.Type)
+	if err == nil || errors.Is(err, event.ErrContentAlreadyParsed) {
+		var decrypted *event.Event
+		decrypted, err = imp.client.Crypto.DecryptMegolmEvent(ctx, evt)
+		if err == nil {
+			dbEvt.Decrypted = decrypted.Content.VeryRaw
+			dbEvt.DecryptedType = decrypted.Type.Type
+			return
+		}
+	}
+	dbEvt.DecryptionError = err.Error()
+	imp.stats.Undecryptable++
+}
+
+// ensureRoom creates a room row for rooms that the account has never synced, as events can't be stored without one.
+func (imp *eventImporter) ensureRoom(ctx context.Context, roomID id.RoomID) error {
+	if imp.knownRooms[roomID] {
+		return nil
+	}
+	room, err := imp.client.DB.Room.Get(ctx, roomID)
+	if err != nil {
+		return fmt.Errorf("failed to get room %s: %w", roomID, err)
+	} else if room == nil {
+		if err = imp.client.DB.Room.CreateRow(ctx, roomID); err != nil {
+			return fmt.Errorf("failed to create room %s: %w", roomID, err)
+		}
+		imp.createdRooms[roomID] = struct{}{}
+	}
+	imp.knownRooms[roomID] = true
+	return nil
+}
+
+// nameCreatedRooms sets the room name from an Element export on the room created by the import.
+// Rooms that already existed keep the name from their synced state.
+func (imp *eventImporter) nameCreatedRooms(ctx context.Context) error {
+	if imp.roomName == "" || len(imp.createdRooms) != 1 {
+		return nil
+	}
+	for roomID := range imp.createdRooms {
+		room, err := imp.client.DB.Room.Get(ctx, roomID)
+		if err != nil {
+			return fmt.Errorf("failed to get room %s: %w", roomID, err)
+		} else if room.Name != nil {
+			return nil
+		}
+		room.Name = &imp.roomName
+		room.NameQuality = database.NameQualityExplicit
+		if err = imp.client.DB.Room.Upsert(ctx, room); err != nil {
+			return fmt.Errorf("failed to set name of room %s: %w", roomID, err)
+		}
+	}
+	return nil
+}
+
+func cmdImport(gmx *gomuks.Gomuks, fs *CommandFlags) error {
+	roomID := fs.MakeFull("r", "room", "Room ID to use for events that don't include one.", "").String()
+	noDecrypt := fs.Make().LongKey("no-decrypt").Usage("Don't try to decrypt encrypted events with the keys of the logged-in account.").Bool()
+	if ok, err := fs.Parse(); !ok {
+		return err
+	} else if fs.NArg() == 0 {
+		fs.PrintHelp()
+		return fmt.Errorf("at least one file is required")
+	}
+	if err := openDatabase(gmx); err != nil {
+		return err
+	}
+	defer closeClient(gmx)
+	imp := newEventImporter(gmx.Client, gmx.Log.With().Str("component", "import").Logger())
+	imp.RoomID = id.RoomID(*roomID)
+	if !*noDecrypt {
+		err := loadAccount(gmx)
+		if errors.Is(err, errNotLoggedIn) {
+			gmx.Log.Warn().Msg("Not logged in, encrypted events will be imported without decrypting them")
+		} else if err != nil {
+			return err
+		} else {
+			imp.Decrypt = true
+		}
+	}
+	ctx := gmx.Log.WithContext(context.Background())
+	for _, path := range fs.Args() {
+		stats, err := imp.ImportFile(ctx, path)
+		if err != nil {
+			return err
+		}
+		gmx.Log.Info().
+			Str("path", path).
+			Int("imported", stats.Imported).
+			Int("duplicate", stats.Duplicate).
+			Int("invalid", stats.Invalid).
+			Int("undecryptable", stats.Undecryptable).
+			Msg("Import complete")
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"golang.org/x/sync/singleflight"
+	"maunium.net/go/mautrix/id"
+)
+
+// JWTConfig configures validation of JWT bearer tokens issued by an OpenID Connect identity provider.
+type JWTConfig struct {
+	// JWKS is the path or http(s) URL of the JSON Web Key Set with the keys of the identity provider.
+	JWKS     string `yaml:"jwks"`
+	Issuer   string `yaml:"issuer"`
+	Audience string `yaml:"audience"`
+	// UsernameClaim is the claim used as the API username, which is also the key for room access rules.
+	UsernameClaim string `yaml:"username_claim"`
+	// ScopesClaim is the claim with the scopes of the user, either as a space-separated string or an array.
+	ScopesClaim string `yaml:"scopes_claim"`
+	// RoomsClaim is an optional claim with an array of room IDs that further restricts the rooms the user can access.
+	RoomsClaim string `yaml:"rooms_claim"`
+}
+
+func (cfg *JWTConfig) applyEnv() {
+	envString("JWT_JWKS", &cfg.JWKS)
+	envString("JWT_ISSUER", &cfg.Issuer)
+	envString("JWT_AUDIENCE", &cfg.Audience)
+	envString("JWT_USERNAME_CLAIM", &cfg.UsernameClaim)
+	envString("JWT_SCOPES_CLAIM", &cfg.ScopesClaim)
+	envString("JWT_ROOMS_CLAIM", &cfg.RoomsClaim)
+	cfg.UsernameClaim = cmp.Or(cfg.UsernameClaim, "sub")
+	cfg.ScopesClaim = cmp.Or(cfg.ScopesClaim, "scope")
+}
+
+func (cfg *JWTConfig) validate() error {
+	if cfg.JWKS == "" || cfg.Issuer == "" || cfg.Audience == "" {
+		return fmt.Errorf("jwks, issuer and audience are required")
+	}
+	return nil
+}
+
+// jwtSignatureAlgorithms are the asymmetric algorithms accepted in tokens.
+// Symmetric algorithms are never accepted, since the key set only contains public keys.
+var jwtSignatureAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+const (
+	// jwksMaxAge is how long keys fetched from a URL are used before they're fetched again.
+	jwksMaxAge = time.Hour
+	// jwksMinRefreshInterval limits how often tokens with unknown key IDs can cause the keys to be fetched again.
+	jwksMinRefreshInterval = time.Minute
+	// jwksMaxSize is the maximum size of a key set response.
+	jwksMaxSize = 1024 * 1024
+)
+
+// jwksSource loads a JSON Web Key Set from a file or URL and refreshes it when it's old
+// or when a token is signed with an unknown key, e.g. after the identity provider rotated its keys.
+// Concurrent refreshes share one fetch, and refreshes within jwksMinRefreshInterval of the last fetch reuse its
+// result, so a burst of tokens with an unknown key ID only fetches the keys once.
+type jwksSource struct {
+	location string
+	client   *http.Client
+	refresh  singleflight.Group
+
+	keys      *jose.JSONWebKeySet
+	fetchedAt time.Time
+	fetchErr  error
+	lock      sync.Mutex
+}
+
+func (js *jwksSource) isURL() bool {
+	return strings.HasPrefix(js.location, "https://") || strings.HasPrefix(js.location, "http://")
+}
+
+func (js *jwksSource) load(ctx context.Context) (*jose.JSONWebKeySet, error) {
+	var data []byte
+	if js.isURL() {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, js.location, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := js.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		data, err = io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(js.location)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var keys jose.JSONWebKeySet
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("failed to parse key set: %w", err)
+	}
+	for _, key := range keys.Keys {
+		if !key.IsPublic() {
+			return nil, fmt.Errorf("key set contains non-public key %q", key.KeyID)
+		}
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("key set is empty")
+	}
+	return &keys, nil
+}
+
+// Refresh loads the key set again. If it fails, the previously loaded keys are kept.
+// Callers that refresh while a fetch is in progress wait for it and get its result, and callers that refresh
+// within jwksMinRefreshInterval of the last fetch get the result of that fetch without fetching again.
+func (js *jwksSource) Refresh(ctx context.Context) error {
+	_, err, _ := js.refresh.Do("", func() (any, error) {
+		// Callers decide to refresh before they get here, so another refresh may have finished in between.
+		js.lock.Lock()
+		recent, lastErr := time.Since(js.fetchedAt) < jwksMinRefreshInterval, js.fetchErr
+		js.lock.Unlock()
+		if recent {
+			return nil, lastErr
+		}
+		// The fetch is shared, so one caller's request being canceled must not fail it for the others.
+		// The HTTP client has a timeout of its own.
+		return nil, js.refreshNow(context.WithoutCancel(ctx))
+	})
+	return err
+}
+
+func (js *jwksSource) refreshNow(ctx context.Context) error {
+	keys, err := js.load(ctx)
+	js.lock.Lock()
+	defer js.lock.Unlock()
+	js.fetchedAt = time.Now()
+	if err != nil {
+		js.fetchErr = fmt.Errorf("failed to load JWKS from %s: %w", js.location, err)
+		return js.fetchErr
+	}
+	js.keys = keys
+	js.fetchErr = nil
+	return nil
+}
+
+// Keys returns the signature keys matching the given key ID, or all signature keys if the ID is empty.
+func (js *jwksSource) Keys(ctx context.Context, keyID string) ([]jose.JSONWebKey, error) {
+	js.lock.Lock()
+	keys := js.keys
+	sinceFetch := time.Since(js.fetchedAt)
+	js.lock.Unlock()
+	matches := filterJWKS(keys, keyID)
+	if (len(matches) == 0 && sinceFetch > jwksMinRefreshInterval) || (js.isURL() && sinceFetch > jwksMaxAge) {
+		if err := js.Refresh(ctx); err != nil {
+			if keys == nil {
+				return nil, err
+			}
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to refresh JWKS, using previously loaded keys")
+		} else {
+			js.lock.Lock()
+			matches = filterJWKS(js.keys, keyID)
+			js.lock.Unlock()
+		}
+	}
+	return matches, nil
+}
+
+func filterJWKS(keys *jose.JSONWebKeySet, keyID string) []jose.JSONWebKey {
+	if keys == nil {
+		return nil
+	}
+	candidates := keys.Keys
+	if keyID != "" {
+		candidates = keys.Key(keyID)
+	}
+	matches := make([]jose.JSONWebKey, 0, len(candidates))
+	for _, key := range candidates {
+		if key.Use == "" || key.Use == "sig" {
+			matches = append(matches, key)
+		}
+	}
+	return matches
+}
+
+// jwtAuthenticator checks bearer JWTs signed by the configured identity provider.
+type jwtAuthenticator struct {
+	config *JWTConfig
+	keys   *jwksSource
+}
+
+// newJWTAuthenticator creates a JWT authenticator and loads the key set, so that a broken configuration fails at startup.
+func newJWTAuthenticator(ctx context.Context, config *JWTConfig) (*jwtAuthenticator, error) {
+	ja := &jwtAuthenticator{
+		config: config,
+		keys: &jwksSource{
+			location: config.JWKS,
+			client:   &http.Client{Timeout: 10 * time.Second},
+		},
+	}
+	if err := ja.keys.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return ja, nil
+}
+
+func (ja *jwtAuthenticator) Challenge() string {
+	return `Bearer realm="Restricted"`
+}
+
+// looksLikeJWT checks if a bearer token has the three dot-separated parts of a compact JWS,
+// which API tokens never have, so that they can be left for tokenAuthenticator.
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+func (ja *jwtAuthenticator) Authenticate(r *http.Request) (*APIUser, error) {
+	raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !looksLikeJWT(raw) {
+		return nil, nil
+	}
+	token, err := jwt.ParseSigned(raw, jwtSignatureAlgorithms)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed JWT: %w", errInvalidCredentials, err)
+	}
+	keys, err := ja.keys.Keys(hlog.FromRequest(r).WithContext(r.Context()), token.Headers[0].KeyID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get JWKS: %w", err)
+	} else if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: unknown JWT key ID %q", errInvalidCredentials, token.Headers[0].KeyID)
+	}
+	var claims jwt.Claims
+	var custom map[string]any
+	for _, key := range keys {
+		if err = token.Claims(key, &claims, &custom); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid JWT signature: %w", errInvalidCredentials, err)
+	}
+	if claims.Expiry == nil {
+		return nil, fmt.Errorf("%w: JWT has no expiry", errInvalidCredentials)
+	}
+	err = claims.Validate(jwt.Expected{
+		Issuer:      ja.config.Issuer,
+		AnyAudience: jwt.Audience{ja.config.Audience},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidCredentials, err)
+	}
+	return ja.mapClaims(custom)
+}
+
+// mapClaims converts the claims of a valid token into an API user.
+func (ja *jwtAuthenticator) mapClaims(claims map[string]any) (*APIUser, error) {
+	username, _ := claims[ja.config.UsernameClaim].(string)
+	if username == "" {
+		return nil, fmt.Errorf("%w: JWT has no %s claim", errInvalidCredentials, ja.config.UsernameClaim)
+	}
+	user := &APIUser{Name: username, Scopes: []Scope{}, Method: "jwt"}
+	// Scopes that aren't ingestor scopes, like openid or profile, are ignored
+	for _, scope := range claimStrings(claims[ja.config.ScopesClaim]) {
+		if slices.Contains(allScopes, Scope(scope)) {
+			user.Scopes = append(user.Scopes, Scope(scope))
+		}
+	}
+	if ja.config.RoomsClaim != "" {
+		if rawRooms, ok := claims[ja.config.RoomsClaim]; ok {
+			user.Rooms = make([]id.RoomID, 0)
+			for _, roomID := range claimStrings(rawRooms) {
+				user.Rooms = append(user.Rooms, id.RoomID(roomID))
+			}
+		}
+	}
+	return user, nil
+}
+
+// claimStrings reads a claim that's either a space-separated string (like the OAuth scope claim) or an array of strings.
+func claimStrings(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
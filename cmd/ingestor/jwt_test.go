@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// newTestJWKSServer serves a key set with one Ed25519 key and counts how often it's fetched.
+// While failing is set, it responds with an error instead.
+func newTestJWKSServer(t *testing.T, keyID string) (*httptest.Server, *atomic.Int32, *atomic.Bool) {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	data, err := json.Marshal(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: pub, KeyID: keyID, Use: "sig"}}})
+	if err != nil {
+		t.Fatalf("failed to marshal key set: %v", err)
+	}
+	var fetches atomic.Int32
+	var failing atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &fetches, &failing
+}
+
+// expireJWKSFetch makes the last fetch of the key set older than the minimum refresh interval.
+func expireJWKSFetch(js *jwksSource) {
+	js.lock.Lock()
+	js.fetchedAt = time.Now().Add(-2 * jwksMinRefreshInterval)
+	js.lock.Unlock()
+}
+
+func TestJWKSSourceSharesConcurrentRefreshes(t *testing.T) {
+	srv, fetches, _ := newTestJWKSServer(t, "key1")
+	js := &jwksSource{location: srv.URL, client: srv.Client()}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			keys, err := js.Keys(context.Background(), "key1")
+			if err != nil {
+				t.Errorf("Keys() error = %v", err)
+			} else if len(keys) != 1 {
+				t.Errorf("Keys() returned %d keys, want 1", len(keys))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("key set was fetched %d times, want 1", n)
+	}
+}
+
+func TestJWKSSourceRefreshAfterFinishedRefresh(t *testing.T) {
+	srv, fetches, failing := newTestJWKSServer(t, "key1")
+	js := &jwksSource{location: srv.URL, client: srv.Client()}
+	ctx := context.Background()
+	if err := js.Refresh(ctx); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	// A caller that saw the old fetch time before the refresh finished refreshes again afterwards
+	if err := js.Refresh(ctx); err != nil {
+		t.Fatalf("second Refresh() error = %v", err)
+	} else if n := fetches.Load(); n != 1 {
+		t.Errorf("key set was fetched %d times by refreshes right after each other, want 1", n)
+	}
+
+	failing.Store(true)
+	expireJWKSFetch(js)
+	if err := js.Refresh(ctx); err == nil {
+		t.Fatal("Refresh() from failing server didn't fail")
+	}
+	if err := js.Refresh(ctx); err == nil {
+		t.Error("Refresh() right after a failed refresh didn't return its error")
+	} else if n := fetches.Load(); n != 2 {
+		t.Errorf("key set was fetched %d times after a failed refresh, want 2", n)
+	}
+	if keys, err := js.Keys(ctx, "key1"); err != nil || len(keys) != 1 {
+		t.Errorf("Keys(key1) after failed refresh = %d keys, %v, want the previously loaded key", len(keys), err)
+	}
+
+	failing.Store(false)
+	expireJWKSFetch(js)
+	if err := js.Refresh(ctx); err != nil {
+		t.Errorf("Refresh() after the interval error = %v", err)
+	} else if n := fetches.Load(); n != 3 {
+		t.Errorf("key set was fetched %d times after the interval, want 3", n)
+	}
+}
+
+func TestJWKSSourceUnknownKeyID(t *testing.T) {
+	srv, fetches, _ := newTestJWKSServer(t, "key1")
+	js := &jwksSource{location: srv.URL, client: srv.Client()}
+	if err := js.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if keys, err := js.Keys(context.Background(), "rotated"); err != nil || len(keys) != 0 {
+			t.Fatalf("Keys(rotated) = %d keys, %v, want no keys", len(keys), err)
+		}
+	}
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("key set was fetched %d times right after a refresh, want 1", n)
+	}
+	// Once the minimum interval has passed, an unknown key ID fetches the keys again
+	expireJWKSFetch(js)
+	if _, err := js.Keys(context.Background(), "rotated"); err != nil {
+		t.Fatalf("Keys(rotated) error = %v", err)
+	} else if n := fetches.Load(); n != 2 {
+		t.Errorf("key set was fetched %d times after the interval, want 2", n)
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/random"
+	"golang.org/x/crypto/pbkdf2"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto"
+	"maunium.net/go/mautrix/id"
+)
+
+// Megolm sessions of the messages sent in a time range.
+const getMegolmSessionsInTimeRangeQuery = `
+	SELECT DISTINCT room_id, megolm_session_id FROM event
+	WHERE megolm_session_id IS NOT NULL AND timestamp >= $1 AND timestamp < $2
+`
+
+const (
+	keyExportPrefix  = "-----BEGIN MEGOLM SESSION DATA-----\n"
+	keyExportSuffix  = "-----END MEGOLM SESSION DATA-----\n"
+	keyExportVersion = 1
+	// keyExportRounds is the number of PBKDF2 rounds used to derive the file key from the passphrase, same as Element.
+	keyExportRounds = 500000
+	// keyExportLineLength is where the base64 data is wrapped.
+	keyExportLineLength = 76
+	// keyExportHeaderLength is the length of the version, salt, IV and round count before the encrypted data.
+	keyExportHeaderLength = 1 + 16 + 16 + 4
+	// keyExportMinLength is the length of the header and the HMAC of a key export. mautrix doesn't check the length
+	// of the decoded data before slicing it, so shorter files would crash the import.
+	keyExportMinLength = keyExportHeaderLength + sha256.Size
+	// maxKeyImportSize is the maximum size of an import request. Exports are a few hundred bytes per session.
+	maxKeyImportSize = 64 << 20
+)
+
+// RoomKeyExportRequest is the request body of the key export endpoint.
+type RoomKeyExportRequest struct {
+	Passphrase string `json:"passphrase"`
+	// RoomIDs limits the export to the sessions of these rooms.
+	RoomIDs []id.RoomID `json:"room_ids,omitempty"`
+	// Since and Until limit the export to the sessions of messages sent in the time range (milliseconds since epoch).
+	Since int64 `json:"since,omitempty"`
+	Until int64 `json:"until,omitempty"`
+}
+
+// RoomKeyImportRequest is the request body of the key import endpoint.
+type RoomKeyImportRequest struct {
+	Passphrase string `json:"passphrase"`
+	// Data is the content of the key export file.
+	Data string `json:"data"`
+}
+
+// RoomKeyImportResponse counts the megolm sessions in an imported key export.
+type RoomKeyImportResponse struct {
+	// Imported sessions were new or better than the ones the ingestor already had.
+	Imported int `json:"imported"`
+	// Total is the number of sessions in the file, including ones that were already known or failed to import.
+	Total int `json:"total"`
+}
+
+// getRoomKeys returns the inbound megolm sessions of the given rooms, or of every room if roomIDs is empty.
+//
+// If since or until is set, only the sessions of messages sent in that time range are returned. The time range
+// is matched against the stored events, because the time a session was received says little about which
+// messages it decrypts.
+func getRoomKeys(ctx context.Context, h *hicli.HiClient, roomIDs []id.RoomID, since, until time.Time) ([]*crypto.InboundGroupSession, error) {
+	var inRange map[roomSession]struct{}
+	if !since.IsZero() || !until.IsZero() {
+		untilMS := int64(math.MaxInt64)
+		if !until.IsZero() {
+			untilMS = until.UnixMilli()
+		}
+		rows, err := h.DB.Query(ctx, getMegolmSessionsInTimeRangeQuery, since.UnixMilli(), untilMS)
+		sessions, err := dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (rs roomSession, err error) {
+			err = row.Scan(&rs.RoomID, &rs.SessionID)
+			return
+		}, err).AsList()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get sessions of messages in time range: %w", err)
+		}
+		inRange = make(map[roomSession]struct{}, len(sessions))
+		roomsInRange := make(map[id.RoomID]struct{})
+		for _, session := range sessions {
+			inRange[session] = struct{}{}
+			roomsInRange[session.RoomID] = struct{}{}
+		}
+		// Only the rooms that have messages in the range need to be read from the crypto store.
+		filteredRoomIDs := make([]id.RoomID, 0, len(roomsInRange))
+		for roomID := range roomsInRange {
+			if len(roomIDs) == 0 || slices.Contains(roomIDs, roomID) {
+				filteredRoomIDs = append(filteredRoomIDs, roomID)
+			}
+		}
+		roomIDs = filteredRoomIDs
+		if len(roomIDs) == 0 {
+			return []*crypto.InboundGroupSession{}, nil
+		}
+	}
+
+	var sessions []*crypto.InboundGroupSession
+	if len(roomIDs) == 0 {
+		var err error
+		if sessions, err = h.CryptoStore.GetAllGroupSessions(ctx).AsList(); err != nil {
+			return nil, fmt.Errorf("failed to get megolm sessions: %w", err)
+		}
+	}
+	for _, roomID := range roomIDs {
+		roomSessions, err := h.CryptoStore.GetGroupSessionsForRoom(ctx, roomID).AsList()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get megolm sessions of %s: %w", roomID, err)
+		}
+		sessions = append(sessions, roomSessions...)
+	}
+	if inRange == nil {
+		return sessions, nil
+	}
+	filtered := sessions[:0]
+	for _, session := range sessions {
+		if _, ok := inRange[roomSession{session.RoomID, session.ID()}]; ok {
+			filtered = append(filtered, session)
+		}
+	}
+	return filtered, nil
+}
+
+// exportRoomKeys encrypts megolm sessions into the key export format of the Matrix spec.
+//
+// mautrix has crypto.ExportKeys for this, but it panics when the output buffer happens to get more capacity than
+// requested, and it leaves out the signing key of the sender, which the importing side needs to show messages
+// as verified.
+func exportRoomKeys(passphrase string, sessions []*crypto.InboundGroupSession) ([]byte, error) {
+	exported := make([]crypto.ExportedSession, len(sessions))
+	for i, session := range sessions {
+		sessionKey, err := session.Internal.Export(session.Internal.FirstKnownIndex())
+		if err != nil {
+			return nil, fmt.Errorf("failed to export session %s: %w", session.ID(), err)
+		}
+		exported[i] = crypto.ExportedSession{
+			Algorithm:         id.AlgorithmMegolmV1,
+			ForwardingChains:  session.ForwardingChains,
+			RoomID:            session.RoomID,
+			SenderKey:         session.SenderKey,
+			SenderClaimedKeys: crypto.SenderClaimedKeys{Ed25519: session.SigningKey},
+			SessionID:         session.ID(),
+			SessionKey:        string(sessionKey),
+		}
+	}
+	plaintext, err := json.Marshal(exported)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := random.Bytes(16)
+	iv := random.Bytes(16)
+	// The spec requires bit 63 of the IV to be zero to work around differences in AES-CTR implementations.
+	iv[8] &= 0x7f
+	key := pbkdf2.Key([]byte(passphrase), salt, keyExportRounds, 64, sha512.New)
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, keyExportHeaderLength+len(plaintext)+sha256.Size)
+	data = append(data, keyExportVersion)
+	data = append(data, salt...)
+	data = append(data, iv...)
+	data = binary.BigEndian.AppendUint32(data, keyExportRounds)
+	encrypted := make([]byte, len(plaintext))
+	cipher.NewCTR(block, iv).XORKeyStream(encrypted, plaintext)
+	data = append(data, encrypted...)
+	mac := hmac.New(sha256.New, key[32:])
+	mac.Write(data)
+	data = mac.Sum(data)
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	var buf bytes.Buffer
+	buf.WriteString(keyExportPrefix)
+	for len(encoded) > keyExportLineLength {
+		buf.WriteString(encoded[:keyExportLineLength])
+		buf.WriteByte('\n')
+		encoded = encoded[keyExportLineLength:]
+	}
+	buf.WriteString(encoded)
+	buf.WriteByte('\n')
+	buf.WriteString(keyExportSuffix)
+	return buf.Bytes(), nil
+}
+
+// importRoomKeys imports a key export file. Decryption of stored events is retried for every imported session.
+func importRoomKeys(ctx context.Context, h *hicli.HiClient, passphrase string, data []byte) (*RoomKeyImportResponse, error) {
+	// Files edited by hand or on Windows may have different line endings than mautrix expects.
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = append(bytes.TrimSpace(data), '\n')
+	if err := checkKeyExport(data); err != nil {
+		return nil, err
+	}
+	imported, total, err := h.Crypto.ImportKeys(ctx, passphrase, data)
+	if err != nil {
+		return nil, err
+	}
+	return &RoomKeyImportResponse{Imported: imported, Total: total}, nil
+}
+
+// errInvalidKeyExport is returned for files that aren't Matrix key exports.
+var errInvalidKeyExport = errors.New("not a Matrix key export file")
+
+func checkKeyExport(data []byte) error {
+	if len(data) < len(keyExportPrefix)+len(keyExportSuffix) ||
+		!bytes.HasPrefix(data, []byte(keyExportPrefix)) || !bytes.HasSuffix(data, []byte(keyExportSuffix)) {
+		return errInvalidKeyExport
+	}
+	// Newlines are ignored when decoding, so the encoded length without them tells how long the decoded data is.
+	encoded := data[len(keyExportPrefix) : len(data)-len(keyExportSuffix)]
+	encodedLength := len(encoded) - bytes.Count(encoded, []byte{'\n'})
+	if encodedLength/4*3 < keyExportMinLength {
+		return errInvalidKeyExport
+	}
+	return nil
+}
+
+// isKeyExportError checks if an import error was caused by the content of the file rather than the ingestor.
+func isKeyExportError(err error) bool {
+	var base64Err base64.CorruptInputError
+	return errors.Is(err, errInvalidKeyExport) ||
+		errors.Is(err, crypto.ErrMissingExportPrefix) ||
+		errors.Is(err, crypto.ErrMissingExportSuffix) ||
+		errors.Is(err, crypto.ErrUnsupportedExportVersion) ||
+		errors.As(err, &base64Err)
+}
+
+// parseKeyExportTime parses a --since or --until value.
+func parseKeyExportTime(flag, val string) (time.Time, error) {
+	if val == "" {
+		return time.Time{}, nil
+	} else if t, err := time.Parse(time.DateOnly, val); err == nil {
+		return t, nil
+	} else if t, err = time.Parse(time.RFC3339, val); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q, expected YYYY-MM-DD or an RFC 3339 timestamp", flag, val)
+}
+
+func cmdKeys(gmx *gomuks.Gomuks, fs *CommandFlags) error {
+	output := fs.MakeFull("o", "output", "Path to write the export to.", "megolm-keys.txt").String()
+	rawSince := fs.Make().LongKey("since").Usage("Only export the sessions of messages sent at or after this date (YYYY-MM-DD or RFC 3339).").String()
+	rawUntil := fs.Make().LongKey("until").Usage("Only export the sessions of messages sent before this date (YYYY-MM-DD or RFC 3339).").String()
+	if ok, err := fs.Parse(); !ok {
+		return err
+	}
+	var run func(ctx context.Context, h *hicli.HiClient, passphrase string) error
+	switch fs.Arg(0) {
+	case "export":
+		since, err := parseKeyExportTime("--since", *rawSince)
+		if err != nil {
+			return err
+		}
+		until, err := parseKeyExportTime("--until", *rawUntil)
+		if err != nil {
+			return err
+		}
+		roomIDs := make([]id.RoomID, fs.NArg()-1)
+		for i, roomID := range fs.Args()[1:] {
+			roomIDs[i] = id.RoomID(roomID)
+		}
+		run = func(ctx context.Context, h *hicli.HiClient, passphrase string) error {
+			sessions, err := getRoomKeys(ctx, h, roomIDs, since, until)
+			if err != nil {
+				return err
+			}
+			data, err := exportRoomKeys(passphrase, sessions)
+			if err != nil {
+				return fmt.Errorf("failed to export keys: %w", err)
+			}
+			if err = os.WriteFile(*output, data, 0600); err != nil {
+				return err
+			}
+			_, _ = fmt.Fprintf(os.Stderr, "Exported %d sessions to %s\n", len(sessions), *output)
+			return nil
+		}
+	case "import":
+		if fs.NArg() != 2 {
+			fs.PrintHelp()
+			return fmt.Errorf("the path of the file to import is required")
+		}
+		data, err := os.ReadFile(fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		run = func(ctx context.Context, h *hicli.HiClient, passphrase string) error {
+			resp, err := importRoomKeys(ctx, h, passphrase, data)
+			if errors.Is(err, crypto.ErrMismatchingExportHash) {
+				return fmt.Errorf("incorrect passphrase")
+			} else if err != nil {
+				return fmt.Errorf("failed to import keys: %w", err)
+			}
+			_, _ = fmt.Fprintf(os.Stderr, "Imported %d of %d sessions\n", resp.Imported, resp.Total)
+			return nil
+		}
+	default:
+		fs.PrintHelp()
+		return fmt.Errorf("unknown subcommand %q, expected export or import", fs.Arg(0))
+	}
+	if err := openClient(gmx); errors.Is(err, errNotLoggedIn) {
+		return fmt.Errorf("%w, run `ingestor login` first", err)
+	} else if err != nil {
+		return err
+	}
+	defer closeClient(gmx)
+	passphrase, err := readSecret("Passphrase: ")
+	if err != nil {
+		return err
+	} else if passphrase == "" {
+		return fmt.Errorf("a passphrase is required")
+	}
+	return run(gmx.Log.WithContext(context.Background()), gmx.Client, passphrase)
+}
+
+// ExportRoomKeys downloads the megolm sessions of the ingestor in the standard encrypted key export format,
+// which other ingestors and Matrix clients can import.
+func (ab *BeeperIngestor) ExportRoomKeys(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	}
+	var req RoomKeyExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, mautrix.MNotJSON.WithMessage("Request body is not valid JSON"))
+		return
+	} else if req.Passphrase == "" {
+		writeError(w, r, errInvalidParam("passphrase", "Passphrase is required"))
+		return
+	} else if req.Since < 0 || req.Until < 0 || (req.Until != 0 && req.Until <= req.Since) {
+		writeError(w, r, errInvalidParam("until", "until must be after since"))
+		return
+	}
+	for _, roomID := range req.RoomIDs {
+		if !roomFilter.Allows(roomID) {
+			writeError(w, r, errNoSuchRoom("room_ids"))
+			return
+		}
+	}
+	var since, until time.Time
+	if req.Since != 0 {
+		since = time.UnixMilli(req.Since)
+	}
+	if req.Until != 0 {
+		until = time.UnixMilli(req.Until)
+	}
+	h, ok := ab.loggedInClient(w, r)
+	if !ok {
+		return
+	}
+	sessions, err := getRoomKeys(r.Context(), h, req.RoomIDs, since, until)
+	if err != nil {
+		log.Err(err).Msg("Failed to get megolm sessions")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get megolm sessions"))
+		return
+	}
+	audit := auditEntryFromContext(r.Context())
+	allowed := sessions[:0]
+	for _, session := range sessions {
+		if roomFilter.Allows(session.RoomID) {
+			allowed = append(allowed, session)
+			audit.AddRooms(session.RoomID)
+		}
+	}
+	audit.SetResultCount(len(allowed))
+	data, err := exportRoomKeys(req.Passphrase, allowed)
+	if err != nil {
+		log.Err(err).Msg("Failed to export megolm sessions")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to export megolm sessions"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="megolm-keys-%s.txt"`, time.Now().UTC().Format("20060102-150405")))
+	_, _ = w.Write(data)
+}
+
+// ImportRoomKeys imports a key export file, such as one made by ExportRoomKeys on another ingestor.
+func (ab *BeeperIngestor) ImportRoomKeys(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	var req RoomKeyImportRequest
+	var maxBytesErr *http.MaxBytesError
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxKeyImportSize)).Decode(&req); errors.As(err, &maxBytesErr) {
+		writeError(w, r, mautrix.MTooLarge.WithMessage("Request body is larger than %d bytes", maxKeyImportSize))
+		return
+	} else if err != nil {
+		writeError(w, r, mautrix.MNotJSON.WithMessage("Request body is not valid JSON"))
+		return
+	} else if req.Passphrase == "" {
+		writeError(w, r, errInvalidParam("passphrase", "Passphrase is required"))
+		return
+	}
+	h, ok := ab.loggedInClient(w, r)
+	if !ok {
+		return
+	}
+	resp, err := importRoomKeys(r.Context(), h, req.Passphrase, []byte(req.Data))
+	if errors.Is(err, crypto.ErrMismatchingExportHash) {
+		writeError(w, r, errInvalidParam("passphrase", "Incorrect passphrase"))
+		return
+	} else if err != nil && isKeyExportError(err) {
+		writeError(w, r, errInvalidParam("data", "Invalid key export file: %v", err))
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Failed to import megolm sessions")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to import megolm sessions"))
+		return
+	}
+	log.Info().Int("imported", resp.Imported).Int("total", resp.Total).Msg("Imported megolm sessions")
+	auditEntryFromContext(r.Context()).SetResultCount(resp.Imported)
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Err(err).Msg("Failed to encode response")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// LockoutConfig controls how failed authentication attempts lock out usernames and client IPs.
+type LockoutConfig struct {
+	// MaxFailures is the number of failures allowed before the first lockout, 0 disables lockouts.
+	MaxFailures int `yaml:"max_failures"`
+	// BaseDuration is the length of the first lockout. Each further failure doubles it.
+	BaseDuration time.Duration `yaml:"base_duration"`
+	// MaxDuration caps the length of a single lockout.
+	MaxDuration time.Duration `yaml:"max_duration"`
+	// ResetAfter is how long after the last failure the failure count is forgotten.
+	ResetAfter time.Duration `yaml:"reset_after"`
+}
+
+func (cfg *LockoutConfig) applyEnv() error {
+	return errors.Join(
+		envInt("AUTH_LOCKOUT_MAX_FAILURES", &cfg.MaxFailures),
+		envDuration("AUTH_LOCKOUT_BASE_DURATION", &cfg.BaseDuration),
+		envDuration("AUTH_LOCKOUT_MAX_DURATION", &cfg.MaxDuration),
+		envDuration("AUTH_LOCKOUT_RESET_AFTER", &cfg.ResetAfter),
+	)
+}
+
+func (cfg *LockoutConfig) validate() error {
+	if cfg.MaxFailures < 0 {
+		return fmt.Errorf("max_failures can't be negative")
+	} else if cfg.BaseDuration <= 0 || cfg.MaxDuration <= 0 || cfg.ResetAfter <= 0 {
+		return fmt.Errorf("base_duration, max_duration and reset_after must be positive")
+	}
+	return nil
+}
+
+type lockoutKey struct {
+	// Kind is either "username" or "ip"
+	Kind  string
+	Value string
+}
+
+type lockoutEntry struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// lockoutPruneInterval is how often entries whose failures have expired are removed from memory.
+const lockoutPruneInterval = time.Minute
+
+// AuthLockout tracks failed authentication attempts per username and per client IP,
+// and locks them out with exponentially increasing durations after too many failures.
+type AuthLockout struct {
+	config LockoutConfig
+	log    zerolog.Logger
+
+	entries   map[lockoutKey]*lockoutEntry
+	lastPrune time.Time
+	lock      sync.Mutex
+}
+
+func NewAuthLockout(config LockoutConfig, log zerolog.Logger) *AuthLockout {
+	return &AuthLockout{
+		config:  config,
+		log:     log,
+		entries: make(map[lockoutKey]*lockoutEntry),
+	}
+}
+
+// SetConfig replaces the lockout settings. Existing failure counts and lockouts are kept.
+func (al *AuthLockout) SetConfig(config LockoutConfig) {
+	al.lock.Lock()
+	al.config = config
+	al.lock.Unlock()
+}
+
+// requestLockoutKeys returns the keys that failures of the request are counted against.
+func requestLockoutKeys(r *http.Request) []lockoutKey {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	keys := []lockoutKey{{Kind: "ip", Value: ip}}
+	if username, _, ok := r.BasicAuth(); ok {
+		keys = append(keys, lockoutKey{Kind: "username", Value: username})
+	}
+	return keys
+}
+
+// Check returns how long the request has to wait if its username or IP is locked out, or zero if it can proceed.
+func (al *AuthLockout) Check(r *http.Request) time.Duration {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.config.MaxFailures == 0 {
+		return 0
+	}
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range requestLockoutKeys(r) {
+		if entry, ok := al.entries[key]; ok && entry.LockedUntil.After(now) {
+			wait = max(wait, entry.LockedUntil.Sub(now))
+		}
+	}
+	return wait
+}
+
+// RecordFailure counts a failed authentication attempt and locks out the username and IP if they have too many failures.
+func (al *AuthLockout) RecordFailure(r *http.Request) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	if al.config.MaxFailures == 0 {
+		return
+	}
+	now := time.Now()
+	al.prune(now)
+	for _, key := range requestLockoutKeys(r) {
+		entry, ok := al.entries[key]
+		if !ok || now.Sub(entry.LastFailure) > al.config.ResetAfter {
+			entry = &lockoutEntry{}
+			al.entries[key] = entry
+		}
+		entry.Failures++
+		entry.LastFailure = now
+		if excess := entry.Failures - al.config.MaxFailures; excess >= 0 {
+			duration := al.config.lockoutDuration(excess)
+			entry.LockedUntil = now.Add(duration)
+			al.log.Warn().
+				Str("lockout_kind", key.Kind).
+				Str("lockout_key", key.Value).
+				Str("remote_addr", r.RemoteAddr).
+				Str("path", r.URL.Path).
+				Int("failures", entry.Failures).
+				Dur("duration", duration).
+				Time("locked_until", entry.LockedUntil).
+				Msg("Locked out after repeated authentication failures")
+		}
+	}
+}
+
+// lockoutDuration returns the length of the lockout after the given number of failures past MaxFailures.
+// The duration doubles with each failure up to MaxDuration. It's compared before shifting, because shifting
+// a duration of a few seconds by 30 or more overflows into a negative value.
+func (cfg *LockoutConfig) lockoutDuration(excess int) time.Duration {
+	duration := cfg.BaseDuration
+	for i := 0; i < excess; i++ {
+		if duration > cfg.MaxDuration>>1 {
+			return cfg.MaxDuration
+		}
+		duration <<= 1
+	}
+	return min(duration, cfg.MaxDuration)
+}
+
+// RecordSuccess clears the failures of the username of a successfully authenticated request.
+//
+// The failures of the IP are kept until they expire. Otherwise anyone with one valid credential could reset the
+// counter of their IP between attempts, and keep guessing the passwords of other usernames.
+func (al *AuthLockout) RecordSuccess(r *http.Request) {
+	al.lock.Lock()
+	defer al.lock.Unlock()
+	for _, key := range requestLockoutKeys(r) {
+		if key.Kind == "username" {
+			delete(al.entries, key)
+		}
+	}
+}
+
+func (al *AuthLockout) prune(now time.Time) {
+	if now.Sub(al.lastPrune) < lockoutPruneInterval {
+		return
+	}
+	al.lastPrune = now
+	for key, entry := range al.entries {
+		if now.Sub(entry.LastFailure) > al.config.ResetAfter && now.After(entry.LockedUntil) {
+			delete(al.entries, key)
+		}
+	}
+}
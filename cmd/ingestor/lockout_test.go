@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		name   string
+		base   time.Duration
+		max    time.Duration
+		excess int
+		want   time.Duration
+	}{
+		{"first lockout", 30 * time.Second, time.Hour, 0, 30 * time.Second},
+		{"doubled", 30 * time.Second, time.Hour, 1, time.Minute},
+		{"doubled twice", 30 * time.Second, time.Hour, 2, 2 * time.Minute},
+		{"capped", 30 * time.Second, time.Hour, 7, time.Hour},
+		{"would overflow at 29", 30 * time.Second, time.Hour, 29, time.Hour},
+		{"would overflow before 32", 5 * time.Second, time.Hour, 31, time.Hour},
+		{"huge excess", time.Second, 24 * time.Hour, 1000, 24 * time.Hour},
+		{"base above max", 2 * time.Hour, time.Hour, 0, time.Hour},
+		{"max near int64 limit", time.Second, 1<<63 - 1, 100, 1<<63 - 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &LockoutConfig{BaseDuration: tt.base, MaxDuration: tt.max}
+			if got := cfg.lockoutDuration(tt.excess); got != tt.want {
+				t.Errorf("lockoutDuration(%d) = %s, want %s", tt.excess, got, tt.want)
+			}
+		})
+	}
+}
+
+func newTestLockout() *AuthLockout {
+	return NewAuthLockout(LockoutConfig{
+		MaxFailures:  3,
+		BaseDuration: 30 * time.Second,
+		MaxDuration:  time.Hour,
+		ResetAfter:   time.Hour,
+	}, zerolog.Nop())
+}
+
+func basicAuthRequest(ip, username string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "/v1/messages", nil)
+	req.RemoteAddr = ip + ":1234"
+	req.SetBasicAuth(username, "password")
+	return req
+}
+
+func TestAuthLockoutLocksOutRepeatedFailures(t *testing.T) {
+	al := newTestLockout()
+	req := basicAuthRequest("192.0.2.1", "alice")
+	for i := 0; i < 2; i++ {
+		al.RecordFailure(req)
+		if wait := al.Check(req); wait != 0 {
+			t.Fatalf("locked out for %s after %d failures, want no lockout", wait, i+1)
+		}
+	}
+	// Keep failing long past the point where shifting the base duration would overflow.
+	for i := 0; i < 100; i++ {
+		al.RecordFailure(req)
+		if wait := al.Check(req); wait <= 0 || wait > time.Hour {
+			t.Fatalf("wait after %d failures = %s, want between 0 and 1h", i+3, wait)
+		}
+	}
+}
+
+func TestAuthLockoutSuccessKeepsIPFailures(t *testing.T) {
+	al := newTestLockout()
+	// Spray wrong passwords for other usernames, and log in with a valid one in between.
+	for i, username := range []string{"bob", "carol", "dave"} {
+		al.RecordFailure(basicAuthRequest("192.0.2.1", username))
+		if i < 2 {
+			al.RecordSuccess(basicAuthRequest("192.0.2.1", "alice"))
+		}
+	}
+	if wait := al.Check(basicAuthRequest("192.0.2.1", "erin")); wait == 0 {
+		t.Error("IP isn't locked out after 3 failures with successful logins in between")
+	}
+	if wait := al.Check(basicAuthRequest("198.51.100.1", "erin")); wait != 0 {
+		t.Errorf("other IP is locked out for %s", wait)
+	}
+}
+
+func TestAuthLockoutSuccessClearsUsername(t *testing.T) {
+	al := newTestLockout()
+	for i := 0; i < 2; i++ {
+		al.RecordFailure(basicAuthRequest("192.0.2.1", "alice"))
+	}
+	al.RecordSuccess(basicAuthRequest("198.51.100.1", "alice"))
+	al.RecordFailure(basicAuthRequest("203.0.113.1", "alice"))
+	if wait := al.Check(basicAuthRequest("203.0.113.1", "alice")); wait != 0 {
+		t.Errorf("username locked out for %s after its failures were cleared", wait)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/chzyer/readline"
+	"github.com/rs/zerolog"
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"go.mau.fi/util/ptr"
+	"go.mau.fi/util/random"
+	"go.mau.fi/zeroconfig"
+	"golang.org/x/crypto/bcrypt"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+)
+
+func gomuksConfigPath(gmx *gomuks.Gomuks) string {
+	return filepath.Join(gmx.ConfigDir, "config.yaml")
+}
+
+// writeDefaultConfig creates config.yaml if it doesn't exist. It returns false if the file already existed.
+//
+// The ingestor doesn't serve the gomuks web UI, but gomuks requires credentials for it in the config,
+// so the file gets a random password that nobody knows.
+func writeDefaultConfig(gmx *gomuks.Gomuks, listenAddress string) (bool, error) {
+	if _, err := os.Stat(gomuksConfigPath(gmx)); err == nil {
+		return false, nil
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(random.String(32)), bcrypt.DefaultCost)
+	if err != nil {
+		return false, fmt.Errorf("failed to hash web UI password: %w", err)
+	}
+	gmx.Config = gomuks.Config{
+		Web: gomuks.WebConfig{
+			ListenAddress: listenAddress,
+			Username:      "ingestor",
+			PasswordHash:  string(passwordHash),
+			TokenKey:      random.String(64),
+		},
+		Logging: zeroconfig.Config{
+			MinLevel: ptr.Ptr(zerolog.InfoLevel),
+			Writers: []zeroconfig.WriterConfig{{
+				Type:   zeroconfig.WriterTypeStdout,
+				Format: zeroconfig.LogFormatPrettyColored,
+			}},
+		},
+	}
+	if err = gmx.SaveConfig(); err != nil {
+		return false, fmt.Errorf("failed to write config: %w", err)
+	}
+	return true, nil
+}
+
+// readSecret reads a password, token or code from the terminal, or a single line from stdin if it's not a terminal.
+func readSecret(prompt string) (string, error) {
+	if !readline.DefaultIsTerminal() {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("failed to read from stdin: %w", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	secret, err := readline.Password(prompt)
+	return string(secret), err
+}
+
+func cmdLogin(gmx *gomuks.Gomuks, fs *CommandFlags) error {
+	homeserver := fs.MakeFull("s", "homeserver", "Homeserver URL. Discovered from the user ID if not set.", "").String()
+	username := fs.MakeFull("u", "user", "Username or user ID to log in with a password.", "").String()
+	loginToken := fs.Make().LongKey("token").Usage("Log in with an m.login.token login token instead of a password.").Bool()
+	email := fs.MakeFull("e", "email", "Log in to Beeper with a code sent to this email address.", "").String()
+	beeperDomain := fs.Make().LongKey("beeper-domain").Usage("Beeper domain for email login.").Default("beeper.com").String()
+	listenAddress := fs.MakeFull("l", "listen", "API listen address to put in config.yaml if it's created.", "localhost:29325").String()
+	deviceName := fs.MakeFull("n", "device-name", "Display name of the new device. Defaults to device.name in ingestor.yaml.", "").String()
+	if ok, err := fs.Parse(); !ok {
+		return err
+	} else if fs.NArg() > 0 {
+		return fmt.Errorf("passwords, tokens and codes are read from stdin, not arguments, to keep them out of shell history")
+	}
+	var login func(ctx context.Context, h *hicli.HiClient) error
+	switch {
+	case *email != "" && (*username != "" || *loginToken):
+		return fmt.Errorf("--email can't be combined with --user or --token")
+	case *email != "":
+		login = func(ctx context.Context, h *hicli.HiClient) error {
+			return loginBeeperEmail(ctx, h, *beeperDomain, *email)
+		}
+	case *loginToken && *username != "":
+		return fmt.Errorf("--token can't be combined with --user")
+	case *loginToken:
+		if *homeserver == "" {
+			return fmt.Errorf("--homeserver is required for token login")
+		}
+		login = func(ctx context.Context, h *hicli.HiClient) error {
+			token, err := readSecret("Login token: ")
+			if err != nil {
+				return err
+			}
+			if err = setHomeserverURL(h, *homeserver); err != nil {
+				return err
+			}
+			return h.Login(ctx, &mautrix.ReqLogin{
+				Type:                     mautrix.AuthTypeToken,
+				Token:                    token,
+				InitialDeviceDisplayName: hicli.InitialDeviceDisplayName,
+			})
+		}
+	case *username != "":
+		if *homeserver == "" && !strings.HasPrefix(*username, "@") {
+			return fmt.Errorf("--homeserver is required if the username isn't a full user ID")
+		}
+		login = func(ctx context.Context, h *hicli.HiClient) error {
+			hsURL, err := resolveHomeserver(ctx, *homeserver, *username)
+			if err != nil {
+				return err
+			}
+			password, err := readSecret("Password: ")
+			if err != nil {
+				return err
+			}
+			return h.LoginPassword(ctx, hsURL, *username, password)
+		}
+	default:
+		fs.PrintHelp()
+		return fmt.Errorf("one of --user, --token or --email is required")
+	}
+
+	initDirectories(gmx)
+	created, err := writeDefaultConfig(gmx, *listenAddress)
+	if err != nil {
+		return err
+	} else if created {
+		_, _ = fmt.Fprintf(os.Stderr, "Created %s\n", gomuksConfigPath(gmx))
+	}
+	loadGomuksConfig(gmx)
+	if *deviceName == "" {
+		configPath, explicit := ingestorConfigPath(gmx.ConfigDir)
+		cfg, err := loadIngestorConfig(configPath, explicit)
+		if err != nil {
+			return err
+		}
+		*deviceName = cfg.Device.DisplayName()
+	}
+	hicli.InitialDeviceDisplayName = *deviceName
+	if err = upgradeDatabase(gmx); err != nil {
+		return err
+	}
+	defer closeClient(gmx)
+	ctx := gmx.Log.WithContext(context.Background())
+	if userID, err := gmx.Client.DB.Account.GetFirstUserID(ctx); err != nil {
+		return fmt.Errorf("failed to check existing account: %w", err)
+	} else if userID != "" {
+		return fmt.Errorf("already logged in as %s, remove the data directory to log in with another account", userID)
+	}
+	if err = login(ctx, gmx.Client); err != nil {
+		return fmt.Errorf("failed to log in: %w", err)
+	}
+	account := gmx.Client.Account
+	_, _ = fmt.Fprintf(os.Stderr, "Logged in as %s with device %s\n", account.UserID, account.DeviceID)
+	_, _ = fmt.Fprintln(os.Stderr, "Verify the device with the recovery key before starting the ingestor, so that it can decrypt messages")
+	return nil
+}
+
+func setHomeserverURL(h *hicli.HiClient, homeserverURL string) error {
+	var err error
+	h.Client.HomeserverURL, err = mautrix.ParseAndNormalizeBaseURL(homeserverURL)
+	if err != nil {
+		return fmt.Errorf("invalid homeserver URL: %w", err)
+	}
+	return nil
+}
+
+// resolveHomeserver returns the homeserver URL if it's set, or discovers it from the server name of a full user ID.
+func resolveHomeserver(ctx context.Context, homeserverURL, username string) (string, error) {
+	if homeserverURL != "" {
+		return homeserverURL, nil
+	}
+	_, serverName, err := id.UserID(username).Parse()
+	if err != nil {
+		return "", fmt.Errorf("invalid user ID: %w", err)
+	}
+	wellKnown, err := mautrix.DiscoverClientAPI(ctx, serverName)
+	if err != nil {
+		return "", fmt.Errorf("failed to discover homeserver of %s: %w", serverName, err)
+	} else if wellKnown == nil {
+		return "https://" + serverName, nil
+	}
+	return wellKnown.Homeserver.BaseURL, nil
+}
+
+// beeperAPIAuth is the static authorization that Beeper clients use for the login endpoints of the Beeper API.
+const beeperAPIAuth = "Bearer BEEPER-PRIVATE-API-PLEASE-DONT-USE"
+
+// loginBeeperEmail logs in to Beeper with a code sent by email. The Beeper API exchanges the code for a JWT,
+// which the Beeper homeserver accepts with the org.matrix.login.jwt login type.
+func loginBeeperEmail(ctx context.Context, h *hicli.HiClient, domain, email string) error {
+	apiURL := "https://api." + domain
+	var start struct {
+		RequestID string `json:"request"`
+	}
+	if err := beeperAPIRequest(ctx, apiURL+"/user/login", nil, &start); err != nil {
+		return fmt.Errorf("failed to start login: %w", err)
+	}
+	emailReq := map[string]string{"request": start.RequestID, "email": email}
+	if err := beeperAPIRequest(ctx, apiURL+"/user/login/email", emailReq, nil); err != nil {
+		return fmt.Errorf("failed to send login code: %w", err)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Sent a login code to %s\n", email)
+	code, err := readSecret("Code: ")
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		Token string `json:"token"`
+	}
+	codeReq := map[string]string{"request": start.RequestID, "response": strings.TrimSpace(code)}
+	if err = beeperAPIRequest(ctx, apiURL+"/user/login/response", codeReq, &resp); err != nil {
+		return fmt.Errorf("failed to check login code: %w", err)
+	}
+	if err = setHomeserverURL(h, "https://matrix."+domain); err != nil {
+		return err
+	}
+	return h.Login(ctx, &mautrix.ReqLogin{
+		Type:                     mautrix.AuthTypeSynapseJWT,
+		Token:                    resp.Token,
+		InitialDeviceDisplayName: hicli.InitialDeviceDisplayName,
+	})
+}
+
+// beeperAPIRequest sends a POST request to the Beeper API and decodes the JSON response into respData if it's not nil.
+func beeperAPIRequest(ctx context.Context, url string, reqData, respData any) error {
+	var body io.Reader
+	if reqData != nil {
+		data, err := json.Marshal(reqData)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", beeperAPIAuth)
+	if reqData != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var errResp struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&errResp) == nil && errResp.Error != "" {
+			return fmt.Errorf("HTTP %d: %s", resp.StatusCode, errResp.Error)
+		}
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	} else if respData != nil {
+		return json.NewDecoder(resp.Body).Decode(respData)
+	}
+	return nil
+}
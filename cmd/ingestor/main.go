@@ -17,25 +17,29 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
 	_ "go.mau.fi/util/dbutil/litestream"
 	flag "maunium.net/go/mauflag"
 	"maunium.net/go/mautrix"
 
 	"go.mau.fi/util/exerrors"
-
-	"crypto/sha256"
-	"encoding/base64"
+	"go.mau.fi/util/exhttp"
 
 	"github.com/beeper/beeper-mc-ingestor/web"
 	"go.mau.fi/gomuks/pkg/gomuks"
@@ -62,7 +66,26 @@ var wantHelp, _ = flag.MakeHelpFlag()
 var version = flag.MakeFull("v", "version", "View ingestor version and quit.", "false").Bool()
 
 type BeeperIngestor struct {
-	gmx         *gomuks.Gomuks
+	gmx            *gomuks.Gomuks
+	db             *IngestorDatabase
+	backfill       *BackfillWorker
+	decryption     *DecryptionRetrier
+	config         atomic.Pointer[IngestorConfig]
+	authenticators atomic.Pointer[[]Authenticator]
+	tlsConfig      *tls.Config
+	lockout        *AuthLockout
+	rateLimiter    *RateLimiter
+	metrics        *Metrics
+	syncMonitor    *SyncMonitor
+	// syncStarted is set once the sync loop has been started, by hicli at startup or by VerifyDevice.
+	syncStarted atomic.Bool
+	// verifyLock serializes device verifications, which change the verification state of the client
+	// (Verified, the cross-signing keys and the key backup key). Requests copy it with verificationState.
+	verifyLock sync.RWMutex
+
+	activeRequests sync.WaitGroup
+	cancelRequests context.CancelFunc
+	serverFailed   atomic.Bool
 }
 
 type Credentials struct {
@@ -71,32 +94,46 @@ type Credentials struct {
 }
 
 func main() {
-	hicli.InitialDeviceDisplayName = "gomuks web"
+	hicli.InitialDeviceDisplayName = defaultDeviceName
 	initVersion(Tag, Commit, BuildTime)
+
+	gmx := gomuks.NewGomuks()
+	gmx.Version = Version
+	gmx.Commit = Commit
+	gmx.LinkifiedVersion = LinkifiedVersion
+	gmx.BuildTime = ParsedBuildTime
+	gmx.FrontendFS = web.Frontend
+
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			runCommand(gmx, os.Args[1], cmd, os.Args[2:])
+		}
+	}
+
 	flag.SetHelpTitles(
 		"ingestor - A thingie for getting messages from a gomuks instance.",
-		"ingestor [-hv]",
+		"ingestor [-hv] [command]",
 	)
 	err := flag.Parse()
 
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		flag.PrintHelp()
+		printCommands()
 		os.Exit(1)
 	} else if *wantHelp {
 		flag.PrintHelp()
+		printCommands()
 		os.Exit(0)
 	} else if *version {
 		fmt.Println(VersionDesc)
 		os.Exit(0)
+	} else if flag.NArg() > 0 {
+		_, _ = fmt.Fprintln(os.Stderr, "Unknown command:", flag.Arg(0))
+		printCommands()
+		os.Exit(1)
 	}
 
-	gmx := gomuks.NewGomuks()
-	gmx.Version = Version
-	gmx.Commit = Commit
-	gmx.LinkifiedVersion = LinkifiedVersion
-	gmx.BuildTime = ParsedBuildTime
-	gmx.FrontendFS = web.Frontend
 	run(gmx)
 }
 
@@ -120,119 +157,142 @@ func initDirectories(gmx *gomuks.Gomuks) {
 	exerrors.PanicIfNotNil(os.MkdirAll(gmx.TempDir, 0700))
 	exerrors.PanicIfNotNil(os.MkdirAll(gmx.DataDir, 0700))
 	exerrors.PanicIfNotNil(os.MkdirAll(gmx.LogDir, 0700))
-
-	configFilePath := filepath.Join(gmx.ConfigDir, "config.yaml")
-	if _, err := os.Stat(configFilePath); os.IsNotExist(err) {
-		panic(fmt.Sprintf("Config file does not exist: %s", configFilePath))
-	}
-	file, err := os.Open(configFilePath)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to open config file: %s", err))
-	}
-	defer file.Close()
 }
 
-func run(gmx *gomuks.Gomuks) {
+// prepareGomuks sets up the directories, config and logging shared by the server and subcommands.
+func prepareGomuks(gmx *gomuks.Gomuks) {
 	initDirectories(gmx)
+	loadGomuksConfig(gmx)
+}
+
+// loadGomuksConfig loads config.yaml and sets up logging. gomuks would ask for web UI credentials on the terminal
+// if the file didn't exist, so a missing file is reported as an error instead.
+func loadGomuksConfig(gmx *gomuks.Gomuks) {
+	configFilePath := gomuksConfigPath(gmx)
+	if _, err := os.Stat(configFilePath); errors.Is(err, os.ErrNotExist) {
+		_, _ = fmt.Fprintf(os.Stderr, "Config file %s doesn't exist, run `ingestor login` to create it\n", configFilePath)
+		os.Exit(9)
+	}
 	err := gmx.LoadConfig()
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, "Failed to load config:", err)
 		os.Exit(9)
 	}
 	gmx.SetupLog()
+}
+
+func run(gmx *gomuks.Gomuks) {
+	prepareGomuks(gmx)
 	gmx.Log.Info().
 		Str("version", gmx.Version).
 		Str("go_version", runtime.Version()).
 		Time("built_at", gmx.BuildTime).
 		Msg("Initializing gomuks")
+	configPath, explicitConfigPath := ingestorConfigPath(gmx.ConfigDir)
+	cfg, err := loadIngestorConfig(configPath, explicitConfigPath)
+	if err != nil {
+		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Str("path", configPath).Msg("Failed to load ingestor config")
+		os.Exit(9)
+	}
+	tlsConfig, err := cfg.Listener.TLSConfig(gmx.Log.With().Str("component", "tls").Logger())
+	if err != nil {
+		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to initialize TLS")
+		os.Exit(9)
+	}
 	ab := &BeeperIngestor{
-		gmx: gmx,
+		gmx:         gmx,
+		tlsConfig:   tlsConfig,
+		rateLimiter: NewRateLimiter(cfg.Limits.RateLimit),
+		lockout:     NewAuthLockout(cfg.Auth.Lockout, gmx.Log.With().Str("component", "auth_lockout").Logger()),
+	}
+	ab.metrics = ab.newMetrics()
+	ab.backfill = ab.NewBackfillWorker(cfg.Backfill)
+	if err = ab.startClient(gmx.Log.WithContext(context.Background())); err != nil {
+		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to start client")
+		os.Exit(12)
+	}
+	ab.db = newIngestorDatabase(gmx.Client.DB.Database)
+	err = ab.db.Upgrade(gmx.Log.WithContext(context.Background()))
+	if err != nil {
+		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to upgrade ingestor database")
+		os.Exit(13)
+	}
+	if err = ab.applyConfig(gmx.Log.WithContext(context.Background()), cfg); err != nil {
+		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to apply ingestor config")
+		os.Exit(9)
+	}
+	go ab.reloadConfigOnSIGHUP()
+	go ab.pruneAuditLog()
+	if err = ab.StartServer(); err != nil {
+		gmx.Log.WithLevel(zerolog.FatalLevel).Err(err).Msg("Failed to start server")
+		os.Exit(14)
 	}
-	ab.StartServer()
-	gmx.StartClient()
+	ab.backfill.Start()
+	ab.decryption.Start()
 	gmx.Log.Info().Msg("Initialization complete")
 	gmx.WaitForInterrupt()
 	gmx.Log.Info().Msg("Shutting down...")
-	gmx.DirectStop()
+	ab.Stop()
 	gmx.Log.Info().Msg("Shutdown complete")
+	if ab.serverFailed.Load() {
+		os.Exit(1)
+	}
 	os.Exit(0)
 }
 
-func (ab *BeeperIngestor) StartServer() {
+// StartServer opens the listeners and starts serving the API. Errors opening the listeners are returned,
+// errors while serving stop the ingestor.
+func (ab *BeeperIngestor) StartServer() error {
 	router := http.NewServeMux()
-	router.HandleFunc("/search-messages", ab.SearchMessages)
+	ab.registerRoutes(router)
 
-	accessList := parseAccessList()
-	handler := basicAuthMiddleware(accessList)(router)
-
-	ab.gmx.Server = &http.Server{
-		Addr:    ab.gmx.Config.Web.ListenAddress,
-		Handler: handler,
-	}
-	go func() {
-		err := ab.gmx.Server.ListenAndServe()
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			panic(err)
-		}
-	}()
-	ab.gmx.Log.Info().Str("address", ab.gmx.Config.Web.ListenAddress).Msg("Server started")
-}
+	apiHandler := exhttp.ApplyMiddleware(
+		jsonRouterErrors(router),
+		ab.metricsMiddleware(router),
+		ab.auditMiddleware,
+		authMiddleware(ab.lockout, func() []Authenticator { return *ab.authenticators.Load() }),
+	)
+	// Probes don't have credentials, so they bypass authentication and the audit log.
+	// The API description is public too, so that client generators can fetch it.
+	probeMux := http.NewServeMux()
+	probeMux.HandleFunc("GET /healthz", ab.Healthz)
+	probeMux.HandleFunc("GET /readyz", ab.Readyz)
+	probeMux.HandleFunc("GET /openapi.json", ab.endpoint(EndpointOpenAPI, ab.GetOpenAPIDocument))
+	probeMux.HandleFunc("GET /docs", ab.endpoint(EndpointOpenAPI, ab.GetAPIDocs))
+	probeMux.Handle("/", apiHandler)
+	// Every request gets a request ID and a logger, including probes, so that their errors can be correlated.
+	handler := exhttp.ApplyMiddleware(
+		probeMux,
+		hlog.NewHandler(*ab.gmx.Log),
+		hlog.RequestIDHandler("request_id", "Request-ID"),
+		probeAccessLogMiddleware(probeMux),
+	)
 
-func parseAccessList() map[string]string {
-	accessList := make(map[string]string)
-	rawList := os.Getenv("ACCESS_LIST")
-	if rawList == "" {
-		log.Fatal("ACCESS_LIST environment variable is required.")
+	listeners, err := ab.listen()
+	if err != nil {
+		return err
 	}
-
-	pairs := strings.Split(rawList, "|")
-	for _, pair := range pairs {
-		creds := strings.Split(pair, ":")
-		if len(creds) != 2 {
-			log.Fatal("Invalid ACCESS_LIST format. Expected format: user:hashedpass|user2:hashedpass2")
-		}
-		// The password should already be hashed using SHA-256 + Base64 from generate-password.py
-		username, hashedPass := creds[0], creds[1]
-
-		// Basic validation of the hash format (SHA-256 in Base64 is always 44 characters)
-		if len(hashedPass) != 44 {
-			log.Fatalf("Invalid hash length for user %s.", username)
-		}
-
-		accessList[username] = hashedPass
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	ab.cancelRequests = cancelRequests
+	ab.gmx.Server = &http.Server{
+		Addr:      ab.gmx.Config.Web.ListenAddress,
+		Handler:   ab.trackRequests(handler),
+		TLSConfig: ab.tlsConfig,
+		BaseContext: func(net.Listener) context.Context {
+			return baseCtx
+		},
 	}
-	return accessList
-}
-
-func basicAuthMiddleware(accessList map[string]string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			username, password, ok := r.BasicAuth()
-			if !ok {
-				w.Header().Set("WWW-Authenticate", `Basic realm="Restricted"`)
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			storedHash, exists := accessList[username]
-			if !exists {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			// Hash the provided password using the same method as generate-password.py
-			hasher := sha256.New()
-			hasher.Write([]byte(password))
-			passwordHash := base64.StdEncoding.EncodeToString(hasher.Sum(nil))
-
-			if storedHash != passwordHash {
-				http.Error(w, "Unauthorized", http.StatusUnauthorized)
-				return
-			}
-
-			next.ServeHTTP(w, r)
-		})
+	go ab.serve(listeners[0], ab.tlsConfig != nil)
+	ab.gmx.Log.Info().
+		Str("address", ab.gmx.Config.Web.ListenAddress).
+		Bool("tls", ab.tlsConfig != nil).
+		Msg("Server started")
+	if len(listeners) > 1 {
+		// The Unix socket is always plain HTTP
+		go ab.serve(listeners[1], false)
+		ab.gmx.Log.Info().Stringer("path", listeners[1].Addr()).Msg("Listening on Unix socket")
 	}
+	return nil
 }
 
 func initVersion(tag, commit, rawBuildTime string) {
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// isMessageEvent checks if an event is a message that the search and export endpoints would return.
+// It must match messageEventCondition.
+func isMessageEvent(evt *database.Event) bool {
+	return evt.Type == event.EventMessage.Type || evt.DecryptedType == event.EventMessage.Type ||
+		(evt.Type == event.EventEncrypted.Type && failedToDecrypt(evt))
+}
+
+// failedToDecrypt checks if an event is encrypted and couldn't be decrypted, so its content is only ciphertext.
+func failedToDecrypt(evt *database.Event) bool {
+	return evt.Decrypted == nil && evt.DecryptionError != ""
+}
+
+// GetMessage returns a single message by its room and event ID.
+func (ab *BeeperIngestor) GetMessage(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	roomID := id.RoomID(r.PathValue("roomID"))
+	eventID := id.EventID(r.PathValue("eventID"))
+
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	} else if !roomFilter.Allows(roomID) {
+		writeError(w, r, errNoSuchRoom("roomID"))
+		return
+	}
+
+	evt, err := ab.gmx.Client.DB.Event.GetByID(r.Context(), eventID)
+	if err != nil {
+		log.Err(err).Str("event_id", eventID.String()).Msg("Failed to get event")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to get message"))
+		return
+	} else if evt == nil || evt.RoomID != roomID || !isMessageEvent(evt) {
+		writeError(w, r, withExtra(mautrix.MNotFound.WithMessage("Message not found"), "param", "eventID"))
+		return
+	}
+	room, err := ab.gmx.Client.DB.Room.Get(r.Context(), roomID)
+	if err != nil {
+		log.Warn().Err(err).Str("room_id", roomID.String()).Msg("Failed to get room info")
+	}
+
+	audit := auditEntryFromContext(r.Context())
+	audit.AddRooms(roomID)
+	audit.SetResultCount(1)
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(ab.eventToMessage(evt, room)); err != nil {
+		log.Err(err).Msg("Failed to encode response")
+	}
+}
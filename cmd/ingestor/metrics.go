@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+)
+
+// Metrics are the Prometheus metrics of the ingestor, served at /metrics.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	syncs           *prometheus.CounterVec
+	lastSync        prometheus.Gauge
+	eventsStored    *prometheus.CounterVec
+	decryptFailures *prometheus.CounterVec
+	lateDecryptions prometheus.Counter
+}
+
+func (ab *BeeperIngestor) newMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ingestor_http_requests_total",
+			Help: "Number of API requests by endpoint, method and status code.",
+		}, []string{"endpoint", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "ingestor_http_request_duration_seconds",
+			Help:    "Latency of API requests by endpoint, method and status code.",
+			Buckets: []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"endpoint", "method", "status"}),
+		syncs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ingestor_syncs_total",
+			Help: "Number of sync requests to the homeserver by result (success or failure).",
+		}, []string{"result"}),
+		lastSync: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "ingestor_last_successful_sync_timestamp_seconds",
+			Help: "Unix time of the last successfully processed sync response.",
+		}),
+		eventsStored: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ingestor_events_stored_total",
+			Help: "Number of events stored in the database by source (sync or backfill).",
+		}, []string{"source"}),
+		decryptFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ingestor_decryption_failures_total",
+			Help: "Number of stored events that couldn't be decrypted by source (sync or backfill).",
+		}, []string{"source"}),
+		lateDecryptions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "ingestor_late_decryptions_total",
+			Help: "Number of stored events that were decrypted after their megolm session arrived late.",
+		}),
+	}
+	// Create the series up front so that they're exported as zero before anything happens
+	m.syncs.WithLabelValues("success")
+	m.syncs.WithLabelValues("failure")
+	for _, source := range []string{"sync", "backfill"} {
+		m.eventsStored.WithLabelValues(source)
+		m.decryptFailures.WithLabelValues(source)
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests,
+		m.requestDuration,
+		m.syncs,
+		m.lastSync,
+		m.eventsStored,
+		m.decryptFailures,
+		m.lateDecryptions,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingestor_sync_running",
+			Help: "Whether the sync loop is running (1) or has stopped (0).",
+		}, func() float64 {
+			return boolToFloat(ab.gmx.Client != nil && ab.gmx.Client.IsSyncing())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingestor_sync_consecutive_failures",
+			Help: "Number of sync requests that have failed in a row since the last successful one.",
+		}, func() float64 {
+			return float64(ab.syncMonitor.ConsecutiveFailures())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "ingestor_database_size_bytes",
+			Help: "Size of the database file including its write-ahead log.",
+		}, func() float64 {
+			return float64(databaseSize(ab.gmx.DataDir))
+		}),
+	)
+	return m
+}
+
+func boolToFloat(val bool) float64 {
+	if val {
+		return 1
+	}
+	return 0
+}
+
+// databaseSize returns the combined size of the SQLite database and its WAL file.
+func databaseSize(dataDir string) (size int64) {
+	for _, name := range []string{"gomuks.db", "gomuks.db-wal"} {
+		if info, err := os.Stat(filepath.Join(dataDir, name)); err == nil {
+			size += info.Size()
+		}
+	}
+	return
+}
+
+// RecordSync counts a sync request, updating the last sync time if it succeeded.
+func (m *Metrics) RecordSync(success bool) {
+	if success {
+		m.syncs.WithLabelValues("success").Inc()
+		m.lastSync.SetToCurrentTime()
+	} else {
+		m.syncs.WithLabelValues("failure").Inc()
+	}
+}
+
+// RecordEvents counts stored events and the ones among them that couldn't be decrypted.
+func (m *Metrics) RecordEvents(source string, events []*database.Event) {
+	var failed int
+	for _, evt := range events {
+		if evt.DecryptionError != "" {
+			failed++
+		}
+	}
+	m.eventsStored.WithLabelValues(source).Add(float64(len(events)))
+	m.decryptFailures.WithLabelValues(source).Add(float64(failed))
+}
+
+// RecordLateDecryption counts events that failed to decrypt when they were stored but were decrypted later.
+func (m *Metrics) RecordLateDecryption(count int) {
+	m.lateDecryptions.Add(float64(count))
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// metricsMiddleware counts requests and measures their latency. Requests are labeled with the route pattern
+// rather than the path, so that room IDs in paths don't create a new time series for every room.
+func (ab *BeeperIngestor) metricsMiddleware(router *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			_, endpoint := router.Handler(r)
+			if endpoint == "" {
+				endpoint = "unmatched"
+			}
+			srw := &statusResponseWriter{ResponseWriter: w}
+			next.ServeHTTP(srw, r)
+			status := strconv.Itoa(max(srw.statusCode, http.StatusOK))
+			ab.metrics.requests.WithLabelValues(endpoint, r.Method, status).Inc()
+			ab.metrics.requestDuration.WithLabelValues(endpoint, r.Method, status).Observe(time.Since(start).Seconds())
+		})
+	}
+}
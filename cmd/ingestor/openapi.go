@@ -0,0 +1,375 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/util/jsontime"
+)
+
+// The OpenAPI document is generated from the route table in routes.go and the Go types of the responses,
+// so that client generators get the same shapes as the handlers encode.
+
+type openAPIDocument struct {
+	OpenAPI    string                                  `json:"openapi"`
+	Info       openAPIInfo                             `json:"info"`
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components openAPIComponents                       `json:"components"`
+}
+
+type openAPIInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+type openAPIOperation struct {
+	OperationID string                      `json:"operationId"`
+	Tags        []string                    `json:"tags,omitempty"`
+	Summary     string                      `json:"summary"`
+	Description string                      `json:"description,omitempty"`
+	Parameters  []*openAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *openAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*openAPIResponse `json:"responses"`
+	Security    []map[string][]string       `json:"security,omitempty"`
+	Deprecated  bool                        `json:"deprecated,omitempty"`
+	// RequiredScope is the scope that API users need for the operation.
+	RequiredScope Scope `json:"x-required-scope,omitempty"`
+}
+
+type openAPIParameter struct {
+	Name        string      `json:"name"`
+	In          string      `json:"in"`
+	Description string      `json:"description,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Schema      *jsonSchema `json:"schema"`
+}
+
+type openAPIRequestBody struct {
+	Required bool                         `json:"required"`
+	Content  map[string]*openAPIMediaType `json:"content"`
+}
+
+type openAPIResponse struct {
+	Description string                       `json:"description"`
+	Content     map[string]*openAPIMediaType `json:"content,omitempty"`
+}
+
+type openAPIMediaType struct {
+	Schema *jsonSchema `json:"schema"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*jsonSchema            `json:"schemas"`
+	SecuritySchemes map[string]*openAPISecurityScheme `json:"securitySchemes"`
+}
+
+type openAPISecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+	Description  string `json:"description,omitempty"`
+}
+
+// jsonSchema is the subset of the OpenAPI 3.0 schema object that the generator uses.
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref,omitempty"`
+	Type                 string                 `json:"type,omitempty"`
+	Format               string                 `json:"format,omitempty"`
+	Description          string                 `json:"description,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Nullable             bool                   `json:"nullable,omitempty"`
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"`
+	OneOf                []*jsonSchema          `json:"oneOf,omitempty"`
+}
+
+func schemaRef(name string) *jsonSchema {
+	return &jsonSchema{Ref: "#/components/schemas/" + name}
+}
+
+// errorSchemaName is the component name of the JSON error response, see errors.go.
+const errorSchemaName = "Error"
+
+var errorSchema = &jsonSchema{
+	Type: "object",
+	Properties: map[string]*jsonSchema{
+		"errcode":        {Type: "string", Description: "Matrix error code, e.g. M_INVALID_PARAM"},
+		"error":          {Type: "string", Description: "Human-readable description of the error"},
+		"param":          {Type: "string", Description: "The parameter that caused the error"},
+		"scope":          {Type: "string", Description: "The missing scope of M_FORBIDDEN errors"},
+		"retry_after_ms": {Type: "integer", Format: "int64", Description: "How long to wait before retrying M_LIMIT_EXCEEDED errors"},
+		"request_id":     {Type: "string", Description: "ID of the request for finding it in the logs and audit log"},
+	},
+	Required: []string{"errcode", "error"},
+}
+
+// schemaOverrides are the schemas of types whose JSON encoding doesn't follow from their Go type,
+// either because they have a custom marshaler or because they're interfaces with known implementations.
+var schemaOverrides = map[reflect.Type]*jsonSchema{
+	reflect.TypeFor[jsontime.UnixMilli](): {Type: "integer", Format: "int64", Description: "Unix timestamp in milliseconds"},
+	reflect.TypeFor[time.Time]():          {Type: "string", Format: "date-time"},
+	reflect.TypeFor[Attachment]():         {OneOf: []*jsonSchema{schemaRef("AttachmentWithURL"), schemaRef("AttachmentWithBuffer")}},
+	reflect.TypeFor[MessageSeen](): {
+		Description: "true, the time the message was seen, or a map of participant IDs to either",
+		OneOf:       []*jsonSchema{{Type: "boolean"}, {Type: "string", Format: "date-time"}, {Type: "object"}},
+	},
+	reflect.TypeFor[BackfillStatus](): {Type: "string", Enum: []string{
+		string(BackfillStatusPending), string(BackfillStatusRunning), string(BackfillStatusComplete),
+		string(BackfillStatusLimitReached), string(BackfillStatusFailed),
+	}},
+	reflect.TypeFor[AttachmentType](): {Type: "string", Enum: []string{
+		string(AttachmentTypeUnknown), string(AttachmentTypeImg), string(AttachmentTypeVideo), string(AttachmentTypeAudio),
+	}},
+	reflect.TypeFor[AttachmentPlayStatus](): {Type: "string", Enum: []string{string(PlayStatusUnplayed), string(PlayStatusPlayed)}},
+}
+
+// schemaGenerator converts Go types to schemas. Named structs become components that are referenced by name.
+type schemaGenerator struct {
+	components map[string]*jsonSchema
+}
+
+func (sg *schemaGenerator) schema(t reflect.Type) *jsonSchema {
+	if override, ok := schemaOverrides[t]; ok {
+		sg.addReferencedComponents(override)
+		return override
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return sg.schema(t.Elem())
+	case reflect.Bool:
+		return &jsonSchema{Type: "boolean"}
+	case reflect.Int64, reflect.Uint64:
+		return &jsonSchema{Type: "integer", Format: "int64"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return &jsonSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &jsonSchema{Type: "number"}
+	case reflect.String:
+		return &jsonSchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &jsonSchema{Type: "string", Format: "byte"}
+		}
+		return &jsonSchema{Type: "array", Items: sg.schema(t.Elem())}
+	case reflect.Map:
+		return &jsonSchema{Type: "object", AdditionalProperties: sg.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sg.structSchema(t)
+		}
+		if _, ok := sg.components[t.Name()]; !ok {
+			// Add a placeholder first in case the type refers to itself
+			sg.components[t.Name()] = nil
+			sg.components[t.Name()] = sg.structSchema(t)
+		}
+		return schemaRef(t.Name())
+	default:
+		// Interfaces and anything else can be any JSON value
+		return &jsonSchema{}
+	}
+}
+
+// addReferencedComponents generates the components that an override schema refers to.
+func (sg *schemaGenerator) addReferencedComponents(schema *jsonSchema) {
+	for _, option := range schema.OneOf {
+		if name, ok := strings.CutPrefix(option.Ref, "#/components/schemas/"); ok {
+			if _, exists := sg.components[name]; !exists {
+				sg.components[name] = nil
+				sg.components[name] = sg.structSchema(openAPIComponentTypes[name])
+			}
+		}
+	}
+}
+
+// openAPIComponentTypes are the types of components that are only referenced from schema overrides.
+var openAPIComponentTypes = map[string]reflect.Type{
+	"AttachmentWithURL":    reflect.TypeFor[AttachmentWithURL](),
+	"AttachmentWithBuffer": reflect.TypeFor[AttachmentWithBuffer](),
+}
+
+// structSchema describes the JSON object of a struct like encoding/json encodes it.
+// Fields with omitempty are optional and embedded structs are flattened.
+func (sg *schemaGenerator) structSchema(t reflect.Type) *jsonSchema {
+	schema := &jsonSchema{Type: "object", Properties: make(map[string]*jsonSchema)}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || (!field.IsExported() && !field.Anonymous) {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			embedded := sg.structSchema(field.Type)
+			for propName, prop := range embedded.Properties {
+				schema.Properties[propName] = prop
+			}
+			schema.Required = append(schema.Required, embedded.Required...)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		prop := sg.schema(field.Type)
+		omitEmpty := strings.Contains(opts, "omitempty")
+		if field.Type.Kind() == reflect.Pointer && !omitEmpty {
+			prop = &jsonSchema{OneOf: []*jsonSchema{prop}, Nullable: true}
+		}
+		schema.Properties[name] = prop
+		if !omitEmpty {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+	return schema
+}
+
+// OpenAPIDocument generates the OpenAPI document of the enabled endpoints.
+func (ab *BeeperIngestor) OpenAPIDocument() *openAPIDocument {
+	sg := &schemaGenerator{components: map[string]*jsonSchema{errorSchemaName: errorSchema}}
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: openAPIInfo{
+			Title:   "Beeper Ingestor API",
+			Version: ab.gmx.Version,
+			Description: "API of the messages stored by the ingestor. Errors use the Matrix error format. " +
+				"Clients can also authenticate with TLS client certificates if the listener requires them.",
+		},
+		Paths: make(map[string]map[string]*openAPIOperation),
+		Components: openAPIComponents{
+			Schemas: sg.components,
+			SecuritySchemes: map[string]*openAPISecurityScheme{
+				"basic": {Type: "http", Scheme: "basic", Description: "Username and password from the access list"},
+				"bearer": {
+					Type:        "http",
+					Scheme:      "bearer",
+					Description: "API token created with `ingestor token create`, or a JWT if JWT authentication is configured",
+				},
+			},
+		},
+	}
+	addOperation := func(method, path string, op *openAPIOperation) {
+		if doc.Paths[path] == nil {
+			doc.Paths[path] = make(map[string]*openAPIOperation)
+		}
+		doc.Paths[path][strings.ToLower(method)] = op
+	}
+	cfg := ab.Config()
+	for _, route := range ab.apiRoutes() {
+		if !cfg.EndpointEnabled(route.Endpoint) {
+			continue
+		}
+		op := sg.operation(route.Doc, append([]int{
+			http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests, http.StatusInternalServerError,
+		}, route.Doc.Errors...))
+		op.Security = []map[string][]string{{"basic": {}}, {"bearer": {}}}
+		op.RequiredScope = route.Scope
+		op.Description = strings.TrimSpace(op.Description + " Requires the " + string(route.Scope) + " scope.")
+		if route.Successor != "" {
+			op.Deprecated = true
+			op.Description += " Deprecated, use " + route.Successor + " instead."
+		}
+		method := route.Method
+		if method == "" {
+			method = http.MethodGet
+		}
+		addOperation(method, route.Path, op)
+	}
+
+	addOperation(http.MethodGet, "/healthz", sg.operation(apiDoc{
+		ID:          "healthz",
+		Tag:         "Health",
+		Summary:     "Liveness probe",
+		Description: "Responds with 200 OK while the process is serving requests. Doesn't need authentication.",
+		Response: &struct {
+			Status string `json:"status"`
+		}{},
+	}, nil))
+	readyz := sg.operation(apiDoc{
+		ID:          "readyz",
+		Tag:         "Health",
+		Summary:     "Readiness probe",
+		Description: "Reports whether the ingestor is logged in, synced and able to serve fresh data. Doesn't need authentication.",
+		Response:    &ReadinessResponse{},
+	}, nil)
+	readyz.Responses[strconv.Itoa(http.StatusServiceUnavailable)] = &openAPIResponse{
+		Description: "Not ready",
+		Content:     map[string]*openAPIMediaType{"application/json": {Schema: sg.schema(reflect.TypeFor[ReadinessResponse]())}},
+	}
+	addOperation(http.MethodGet, "/readyz", readyz)
+	return doc
+}
+
+// operation converts route documentation to an OpenAPI operation with the given error responses.
+func (sg *schemaGenerator) operation(doc apiDoc, errorCodes []int) *openAPIOperation {
+	op := &openAPIOperation{
+		OperationID: doc.ID,
+		Tags:        []string{doc.Tag},
+		Summary:     doc.Summary,
+		Description: doc.Description,
+		Responses:   make(map[string]*openAPIResponse),
+	}
+	for _, param := range doc.Params {
+		schema := &jsonSchema{Type: param.Type}
+		if param.Repeated {
+			schema = &jsonSchema{Type: "array", Items: schema}
+		}
+		op.Parameters = append(op.Parameters, &openAPIParameter{
+			Name:        param.Name,
+			In:          param.In,
+			Description: param.Description,
+			Required:    param.Required,
+			Schema:      schema,
+		})
+	}
+	if doc.Request != nil {
+		op.RequestBody = &openAPIRequestBody{
+			Required: true,
+			Content:  map[string]*openAPIMediaType{"application/json": {Schema: sg.schema(reflect.TypeOf(doc.Request))}},
+		}
+	}
+	success := &openAPIResponse{Description: "Success"}
+	switch {
+	case doc.Response != nil && doc.ContentType != "":
+		success.Description = "Stream of " + reflect.TypeOf(doc.Response).Elem().Name() + " objects"
+		success.Content = map[string]*openAPIMediaType{doc.ContentType: {Schema: sg.schema(reflect.TypeOf(doc.Response))}}
+	case doc.Response != nil:
+		success.Content = map[string]*openAPIMediaType{"application/json": {Schema: sg.schema(reflect.TypeOf(doc.Response))}}
+	case strings.HasPrefix(doc.ContentType, "text/"):
+		success.Content = map[string]*openAPIMediaType{doc.ContentType: {Schema: &jsonSchema{Type: "string"}}}
+	default:
+		success.Content = map[string]*openAPIMediaType{doc.ContentType: {Schema: &jsonSchema{Type: "string", Format: "binary"}}}
+	}
+	op.Responses[strconv.Itoa(http.StatusOK)] = success
+	for _, code := range errorCodes {
+		op.Responses[strconv.Itoa(code)] = &openAPIResponse{
+			Description: http.StatusText(code),
+			Content:     map[string]*openAPIMediaType{"application/json": {Schema: schemaRef(errorSchemaName)}},
+		}
+	}
+	return op
+}
+
+// GetOpenAPIDocument serves the OpenAPI document. Disabled endpoints are left out.
+func (ab *BeeperIngestor) GetOpenAPIDocument(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ab.OpenAPIDocument()); err != nil {
+		hlog.FromRequest(r).Err(err).Msg("Failed to encode OpenAPI document")
+	}
+}
+
+//go:embed openapi.html
+var apiDocsPage []byte
+
+// GetAPIDocs serves a page that renders the OpenAPI document and can send requests to the API.
+func (ab *BeeperIngestor) GetAPIDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(apiDocsPage)
+}
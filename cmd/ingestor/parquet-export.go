@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/rs/zerolog"
+	"go.mau.fi/gomuks/pkg/hicli/database"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// ParquetFormatVersion is bumped whenever the schema of the Parquet export changes incompatibly.
+const ParquetFormatVersion = 1
+
+const parquetStateFileName = "_ingestor_state.json"
+
+// ParquetMessage is a row in the messages dataset, which is partitioned by day as messages/date=YYYY-MM-DD/*.parquet
+type ParquetMessage struct {
+	EventRowID     int64  `parquet:"event_rowid"`
+	EventID        string `parquet:"event_id"`
+	Timestamp      int64  `parquet:"timestamp,timestamp(millisecond)"`
+	RoomID         string `parquet:"room_id,dict"`
+	Network        string `parquet:"network,optional,dict"`
+	Sender         string `parquet:"sender,dict"`
+	MsgType        string `parquet:"msgtype,optional,dict"`
+	TextLength     int32  `parquet:"text_length"`
+	ReplyToEventID string `parquet:"reply_to_event_id,optional"`
+	ThreadID       string `parquet:"thread_id,optional"`
+	EditOfEventID  string `parquet:"edit_of_event_id,optional"`
+	ReactionCount  int32  `parquet:"reaction_count"`
+	Encrypted      bool   `parquet:"encrypted"`
+	Redacted       bool   `parquet:"redacted"`
+}
+
+// ParquetRoom is a row in the rooms dataset, which is a snapshot rewritten on every export.
+type ParquetRoom struct {
+	RoomID            string `parquet:"room_id"`
+	Name              string `parquet:"name,optional"`
+	Network           string `parquet:"network,optional,dict"`
+	Encrypted         bool   `parquet:"encrypted"`
+	JoinedMemberCount int32  `parquet:"joined_member_count"`
+	LastActivity      int64  `parquet:"last_activity,optional,timestamp(millisecond)"`
+}
+
+// ParquetParticipant is a row in the participants dataset, which is a snapshot rewritten on every export.
+type ParquetParticipant struct {
+	RoomID      string `parquet:"room_id,dict"`
+	UserID      string `parquet:"user_id"`
+	DisplayName string `parquet:"display_name,optional"`
+	Membership  string `parquet:"membership,dict"`
+}
+
+// ParquetExportState is stored in the export directory to make subsequent exports incremental.
+type ParquetExportState struct {
+	FormatVersion  int                 `json:"format_version"`
+	LastEventRowID database.EventRowID `json:"last_event_rowid"`
+	// PendingRowIDs are the exported range's encrypted events that weren't decrypted yet. They're checked on the
+	// next export, because decrypting them later (by the retrier, a key import or a backup restore) doesn't
+	// change their rowid.
+	PendingRowIDs []database.EventRowID `json:"pending_rowids,omitempty"`
+	UpdatedAt     jsontime.UnixMilli    `json:"updated_at"`
+}
+
+type ParquetExportResult struct {
+	Messages   int
+	Partitions int
+	// Rewritten is the number of previously exported partitions that were rewritten because their messages changed.
+	Rewritten    int
+	Rooms        int
+	Participants int
+}
+
+const parquetWriteBatchSize = 1000
+
+// parquetFile buffers rows and writes them to a temporary file that is only moved into place once it's complete.
+type parquetFile[T any] struct {
+	path   string
+	file   *os.File
+	writer *parquet.GenericWriter[T]
+	buf    []T
+}
+
+func createParquetFile[T any](path string) (*parquetFile[T], error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &parquetFile[T]{
+		path: path,
+		file: file,
+		writer: parquet.NewGenericWriter[T](
+			file,
+			parquet.Compression(&parquet.Zstd),
+			parquet.CreatedBy("ingestor", Version, Commit),
+		),
+		buf: make([]T, 0, parquetWriteBatchSize),
+	}, nil
+}
+
+func (pf *parquetFile[T]) Write(row T) error {
+	pf.buf = append(pf.buf, row)
+	if len(pf.buf) >= parquetWriteBatchSize {
+		return pf.flush()
+	}
+	return nil
+}
+
+func (pf *parquetFile[T]) flush() error {
+	_, err := pf.writer.Write(pf.buf)
+	pf.buf = pf.buf[:0]
+	return err
+}
+
+func (pf *parquetFile[T]) Close() error {
+	if err := pf.flush(); err != nil {
+		return err
+	} else if err = pf.writer.Close(); err != nil {
+		return err
+	} else if err = pf.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(pf.path+".tmp", pf.path)
+}
+
+func (pf *parquetFile[T]) Abort() {
+	_ = pf.file.Close()
+	_ = os.Remove(pf.path + ".tmp")
+}
+
+func readParquetExportState(dir string) (*ParquetExportState, error) {
+	data, err := os.ReadFile(filepath.Join(dir, parquetStateFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return &ParquetExportState{FormatVersion: ParquetFormatVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state ParquetExportState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse export state: %w", err)
+	} else if state.FormatVersion != ParquetFormatVersion {
+		return nil, fmt.Errorf("export directory was created with format version %d, expected %d", state.FormatVersion, ParquetFormatVersion)
+	}
+	return &state, nil
+}
+
+func writeParquetExportState(dir string, state *ParquetExportState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, parquetStateFileName)
+	if err = os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+const (
+	getParquetMessagesQuery = messageEventBaseQuery + `
+		WHERE (event.type = 'm.room.message' OR event.decrypted_type = 'm.room.message')
+		  AND event.rowid > $1 AND event.rowid <= $2
+		ORDER BY event.timestamp ASC, event.rowid ASC
+	`
+	getParquetPartitionMessagesQuery = messageEventBaseQuery + `
+		WHERE (event.type = 'm.room.message' OR event.decrypted_type = 'm.room.message')
+		  AND event.timestamp >= $1 AND event.timestamp < $2 AND event.rowid <= $3
+		ORDER BY event.timestamp ASC, event.rowid ASC
+	`
+	getParquetPendingRowIDsQuery = `
+		SELECT rowid FROM event WHERE rowid <= $1 AND type = 'm.room.encrypted' AND decrypted_type IS NULL
+	`
+	// getParquetChangedDatesQuery finds the days of exported messages that changed since the last export:
+	// messages that were decrypted, and messages that got reactions, edits or redactions from new or newly
+	// decrypted events. $1 is the last exported rowid, $2 the current one and $3 the pending rowids.
+	getParquetChangedDatesQuery = `
+		WITH changed AS (
+			SELECT room_id, relates_to, relation_type, content ->> 'redacts' AS redacts
+			FROM event
+			WHERE (rowid > $1 AND rowid <= $2) OR rowid IN (SELECT value FROM json_each($3))
+		)
+		SELECT date(target.timestamp / 1000, 'unixepoch')
+		FROM changed
+		JOIN event target ON target.room_id = changed.room_id
+			AND (target.event_id = changed.redacts
+				OR (target.event_id = changed.relates_to AND changed.relation_type IN ('m.annotation', 'm.replace')))
+		WHERE target.rowid <= $1 AND (target.type = 'm.room.message' OR target.decrypted_type = 'm.room.message')
+		UNION
+		SELECT date(timestamp / 1000, 'unixepoch')
+		FROM event
+		WHERE rowid IN (SELECT value FROM json_each($3)) AND decrypted_type = 'm.room.message'
+	`
+)
+
+func scanEvent(row dbutil.Scannable) (*database.Event, error) {
+	return (&database.Event{}).Scan(row)
+}
+
+func newParquetMessage(evt *database.Event, networks map[id.RoomID]string) ParquetMessage {
+	var content event.MessageEventContent
+	_ = json.Unmarshal(rawMessageContent(evt), &content)
+	msg := ParquetMessage{
+		EventRowID:     int64(evt.RowID),
+		EventID:        evt.ID.String(),
+		Timestamp:      evt.Timestamp.UnixMilli(),
+		RoomID:         evt.RoomID.String(),
+		Network:        networks[evt.RoomID],
+		Sender:         evt.Sender.String(),
+		MsgType:        string(content.MsgType),
+		TextLength:     int32(utf8.RuneCountInString(content.Body)),
+		ReplyToEventID: content.RelatesTo.GetNonFallbackReplyTo().String(),
+		ThreadID:       content.RelatesTo.GetThreadParent().String(),
+		EditOfEventID:  content.RelatesTo.GetReplaceID().String(),
+		Encrypted:      evt.Type == event.EventEncrypted.Type,
+		Redacted:       evt.RedactedBy != "",
+	}
+	for _, count := range evt.Reactions {
+		msg.ReactionCount += int32(count)
+	}
+	return msg
+}
+
+// ExportParquet writes messages, rooms and participants to Parquet files in the given directory.
+//
+// Messages are appended incrementally: only messages stored since the previous export into the same directory
+// are written, into new part files in the day partitions they belong to. Day partitions with messages that
+// changed since then, because they were decrypted later or got reactions, edits or redactions, are rewritten
+// as a whole. Rooms and participants are small, so they're rewritten as full snapshots every time.
+//
+// If full is true, the previous export in the directory is discarded and all messages are written again.
+func (ab *BeeperIngestor) ExportParquet(ctx context.Context, dir string, full bool) (*ParquetExportResult, error) {
+	log := zerolog.Ctx(ctx)
+	if full {
+		if err := os.RemoveAll(filepath.Join(dir, "messages")); err != nil {
+			return nil, fmt.Errorf("failed to remove previous export: %w", err)
+		} else if err = os.Remove(filepath.Join(dir, parquetStateFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove previous export state: %w", err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	state, err := readParquetExportState(dir)
+	if err != nil {
+		return nil, err
+	}
+	db := ab.gmx.Client.DB
+	var maxRowID database.EventRowID
+	err = db.QueryRow(ctx, "SELECT COALESCE(MAX(rowid), 0) FROM event").Scan(&maxRowID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest event rowid: %w", err)
+	}
+	changedDates, err := getParquetChangedDates(ctx, db.Database, state, maxRowID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find changed messages: %w", err)
+	}
+	pendingRowIDs, err := getParquetPendingRowIDs(ctx, db.Database, maxRowID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find undecrypted messages: %w", err)
+	}
+	networks, err := ab.GetRoomNetworks(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get room networks: %w", err)
+	}
+
+	result := &ParquetExportResult{}
+	pw := &parquetMessageWriter{dir: dir, networks: networks, result: result}
+	var stale []string
+	// Changed partitions are rewritten with all of their messages up to the current rowid, so the new messages
+	// in them are skipped below. The old part files are only removed once the whole export has succeeded.
+	for _, date := range changedDates {
+		start, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			return nil, fmt.Errorf("invalid partition date %q: %w", date, err)
+		}
+		partName := fmt.Sprintf("part-1-%d.parquet", maxRowID)
+		rows, err := db.Query(ctx, getParquetPartitionMessagesQuery, start.UnixMilli(), start.AddDate(0, 0, 1).UnixMilli(), maxRowID)
+		if err = pw.writeAll(rows, err, partName, nil); err != nil {
+			pw.abort()
+			return nil, fmt.Errorf("failed to rewrite messages of %s: %w", date, err)
+		}
+		partitionDir := filepath.Join(dir, "messages", "date="+date)
+		oldParts, err := filepath.Glob(filepath.Join(partitionDir, "part-*.parquet"))
+		if err != nil {
+			pw.abort()
+			return nil, err
+		}
+		for _, path := range oldParts {
+			if path != filepath.Join(partitionDir, partName) {
+				stale = append(stale, path)
+			}
+		}
+		result.Rewritten++
+	}
+	partName := fmt.Sprintf("part-%d-%d.parquet", state.LastEventRowID+1, maxRowID)
+	rows, err := db.Query(ctx, getParquetMessagesQuery, state.LastEventRowID, maxRowID)
+	if err = pw.writeAll(rows, err, partName, changedDates); err != nil {
+		pw.abort()
+		return nil, fmt.Errorf("failed to export messages: %w", err)
+	}
+
+	result.Rooms, err = ab.exportParquetRooms(ctx, filepath.Join(dir, "rooms.parquet"), networks)
+	if err != nil {
+		pw.abort()
+		return nil, fmt.Errorf("failed to export rooms: %w", err)
+	}
+	result.Participants, err = ab.exportParquetParticipants(ctx, filepath.Join(dir, "participants.parquet"))
+	if err != nil {
+		pw.abort()
+		return nil, fmt.Errorf("failed to export participants: %w", err)
+	}
+
+	// If removing a stale part fails, the state isn't saved, so the next run finds the same changes and
+	// rewrites the partition again instead of leaving duplicate rows.
+	for _, path := range stale {
+		if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove rewritten part file: %w", err)
+		}
+	}
+	state.LastEventRowID = maxRowID
+	state.PendingRowIDs = pendingRowIDs
+	state.UpdatedAt = jsontime.UnixMilliNow()
+	if err = writeParquetExportState(dir, state); err != nil {
+		return nil, fmt.Errorf("failed to save export state: %w", err)
+	}
+	log.Info().
+		Int("messages", result.Messages).
+		Int("partitions", result.Partitions).
+		Int("rewritten_partitions", result.Rewritten).
+		Int("pending_encrypted", len(pendingRowIDs)).
+		Int64("last_event_rowid", int64(maxRowID)).
+		Msg("Parquet export complete")
+	return result, nil
+}
+
+// getParquetChangedDates returns the dates of the day partitions that have messages which changed since the
+// previous export, sorted.
+func getParquetChangedDates(ctx context.Context, db *dbutil.Database, state *ParquetExportState, maxRowID database.EventRowID) ([]string, error) {
+	if state.LastEventRowID == 0 {
+		return nil, nil
+	}
+	pending, err := json.Marshal(state.PendingRowIDs)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(ctx, getParquetChangedDatesQuery, state.LastEventRowID, maxRowID, string(pending))
+	dates, err := dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[string], err).AsList()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(dates)
+	return dates, nil
+}
+
+// getParquetPendingRowIDs returns the encrypted events up to the given rowid that haven't been decrypted.
+func getParquetPendingRowIDs(ctx context.Context, db *dbutil.Database, maxRowID database.EventRowID) ([]database.EventRowID, error) {
+	rows, err := db.Query(ctx, getParquetPendingRowIDsQuery, maxRowID)
+	return dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[database.EventRowID], err).AsList()
+}
+
+// parquetMessageWriter writes messages into day partitions, starting a new part file whenever the date changes.
+type parquetMessageWriter struct {
+	dir      string
+	networks map[id.RoomID]string
+	result   *ParquetExportResult
+
+	written []string
+	current *parquetFile[ParquetMessage]
+}
+
+// writeAll writes the messages of the query result into part files with the given name, skipping messages
+// on the given dates. The messages must be sorted by timestamp.
+func (pw *parquetMessageWriter) writeAll(rows dbutil.Rows, err error, partName string, skipDates []string) error {
+	var currentDate string
+	err = dbutil.NewRowIterWithError(rows, scanEvent, err).Iter(func(evt *database.Event) (bool, error) {
+		date := evt.Timestamp.UTC().Format(time.DateOnly)
+		if slices.Contains(skipDates, date) {
+			return true, nil
+		}
+		if date != currentDate {
+			if err := pw.closeCurrent(); err != nil {
+				return false, err
+			}
+			var err error
+			pw.current, err = createParquetFile[ParquetMessage](filepath.Join(pw.dir, "messages", "date="+date, partName))
+			if err != nil {
+				return false, err
+			}
+			currentDate = date
+			pw.result.Partitions++
+		}
+		pw.result.Messages++
+		return true, pw.current.Write(newParquetMessage(evt, pw.networks))
+	})
+	if err != nil {
+		return err
+	}
+	return pw.closeCurrent()
+}
+
+func (pw *parquetMessageWriter) closeCurrent() error {
+	if pw.current == nil {
+		return nil
+	}
+	err := pw.current.Close()
+	pw.written = append(pw.written, pw.current.path)
+	pw.current = nil
+	return err
+}
+
+// abort removes the part files written in this run, so the next run can write them again without duplicating rows.
+func (pw *parquetMessageWriter) abort() {
+	if pw.current != nil {
+		pw.current.Abort()
+		pw.current = nil
+	}
+	for _, path := range pw.written {
+		_ = os.Remove(path)
+	}
+}
+
+const getParquetRoomsQuery = `
+	SELECT room.room_id, room.name, room.encryption_event IS NOT NULL, room.sorting_timestamp,
+	       (SELECT COUNT(*) FROM current_state cs
+	        WHERE cs.room_id = room.room_id AND cs.event_type = 'm.room.member' AND cs.membership = 'join')
+	FROM room
+`
+
+func (ab *BeeperIngestor) exportParquetRooms(ctx context.Context, path string, networks map[id.RoomID]string) (int, error) {
+	pf, err := createParquetFile[ParquetRoom](path)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	rows, err := ab.gmx.Client.DB.Query(ctx, getParquetRoomsQuery)
+	err = dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (room ParquetRoom, err error) {
+		var name sql.NullString
+		var lastActivity sql.NullInt64
+		err = row.Scan(&room.RoomID, &name, &room.Encrypted, &lastActivity, &room.JoinedMemberCount)
+		room.Name = name.String
+		room.LastActivity = lastActivity.Int64
+		room.Network = networks[id.RoomID(room.RoomID)]
+		return
+	}, err).Iter(func(room ParquetRoom) (bool, error) {
+		count++
+		return true, pf.Write(room)
+	})
+	if err != nil {
+		pf.Abort()
+		return 0, err
+	}
+	return count, pf.Close()
+}
+
+const getParquetParticipantsQuery = `
+	SELECT cs.room_id, cs.state_key, COALESCE(cs.membership, ''), event.content ->> '$.displayname'
+	FROM current_state cs
+	JOIN event ON event.rowid = cs.event_rowid
+	WHERE cs.event_type = 'm.room.member'
+`
+
+func (ab *BeeperIngestor) exportParquetParticipants(ctx context.Context, path string) (int, error) {
+	pf, err := createParquetFile[ParquetParticipant](path)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	rows, err := ab.gmx.Client.DB.Query(ctx, getParquetParticipantsQuery)
+	err = dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (participant ParquetParticipant, err error) {
+		var displayName sql.NullString
+		err = row.Scan(&participant.RoomID, &participant.UserID, &participant.Membership, &displayName)
+		participant.DisplayName = displayName.String
+		return
+	}, err).Iter(func(participant ParquetParticipant) (bool, error) {
+		count++
+		return true, pf.Write(participant)
+	})
+	if err != nil {
+		pf.Abort()
+		return 0, err
+	}
+	return count, pf.Close()
+}
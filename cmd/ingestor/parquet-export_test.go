@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"go.mau.fi/gomuks/pkg/hicli/database"
+	"go.mau.fi/util/dbutil"
+)
+
+func newTestClientDatabase(t *testing.T) *database.Database {
+	t.Helper()
+	rawDB, err := dbutil.NewWithDialect(":memory:", "sqlite3")
+	if err != nil {
+		t.Fatalf("failed to open database: %v", err)
+	}
+	t.Cleanup(func() { _ = rawDB.Close() })
+	db := database.New(rawDB)
+	if err = db.Upgrade(context.Background()); err != nil {
+		t.Fatalf("failed to upgrade database: %v", err)
+	}
+	_, err = db.Exec(context.Background(), "INSERT INTO room (room_id) VALUES ('!room:example.com')")
+	if err != nil {
+		t.Fatalf("failed to insert room: %v", err)
+	}
+	return db
+}
+
+func TestParquetChangedDates(t *testing.T) {
+	ctx := context.Background()
+	db := newTestClientDatabase(t)
+	exec := func(query string) {
+		t.Helper()
+		if _, err := db.Exec(ctx, query); err != nil {
+			t.Fatalf("failed to execute %q: %v", query, err)
+		}
+	}
+	// Timestamps are midnight UTC of 2024-01-01 to 2024-01-04
+	exec(`INSERT INTO event (rowid, room_id, event_id, sender, type, timestamp, content, unsigned, decrypted_type, relates_to, relation_type)
+		VALUES (1, '!room:example.com', '$m1', '@a:example.com', 'm.room.message', 1704067200000, '{}', '{}', NULL, NULL, NULL),
+		       (2, '!room:example.com', '$m2', '@a:example.com', 'm.room.message', 1704153600000, '{}', '{}', NULL, NULL, NULL),
+		       (3, '!room:example.com', '$e3', '@a:example.com', 'm.room.encrypted', 1704240000000, '{}', '{}', NULL, NULL, NULL),
+		       (4, '!room:example.com', '$m4', '@a:example.com', 'm.room.message', 1704240000000, '{}', '{}', NULL, NULL, NULL),
+		       (5, '!room:example.com', '$r5', '@b:example.com', 'm.reaction', 1704326400000, '{}', '{}', NULL, '$m1', 'm.annotation'),
+		       (6, '!room:example.com', '$t6', '@b:example.com', 'm.room.message', 1704326400000, '{}', '{}', NULL, '$m2', 'm.thread')`)
+
+	tests := []struct {
+		name        string
+		exec        string
+		state       ParquetExportState
+		maxRowID    database.EventRowID
+		wantDates   []string
+		wantPending []database.EventRowID
+	}{
+		{"first export", "", ParquetExportState{}, 4, nil, []database.EventRowID{3}},
+		{"reaction to exported message", "", ParquetExportState{LastEventRowID: 4, PendingRowIDs: []database.EventRowID{3}}, 6, []string{"2024-01-01"}, []database.EventRowID{3}},
+		{"nothing new", "", ParquetExportState{LastEventRowID: 6, PendingRowIDs: []database.EventRowID{3}}, 6, nil, []database.EventRowID{3}},
+		{
+			"decrypted later",
+			"UPDATE event SET decrypted = '{}', decrypted_type = 'm.room.message' WHERE rowid = 3",
+			ParquetExportState{LastEventRowID: 6, PendingRowIDs: []database.EventRowID{3}}, 6, []string{"2024-01-03"}, nil,
+		},
+		{"decrypted before the last export", "", ParquetExportState{LastEventRowID: 6}, 6, nil, nil},
+		{
+			"redaction and edit",
+			`INSERT INTO event (rowid, room_id, event_id, sender, type, timestamp, content, unsigned, relates_to, relation_type)
+				VALUES (7, '!room:example.com', '$x7', '@a:example.com', 'm.room.redaction', 1704326400000, '{"redacts":"$m2"}', '{}', NULL, NULL),
+				       (8, '!room:example.com', '$x8', '@a:example.com', 'm.room.message', 1704326400000, '{}', '{}', '$m4', 'm.replace')`,
+			ParquetExportState{LastEventRowID: 6}, 8, []string{"2024-01-02", "2024-01-03"}, nil,
+		},
+		{"changes to messages that weren't exported yet", "", ParquetExportState{LastEventRowID: 1}, 8, []string{"2024-01-01"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.exec != "" {
+				exec(tt.exec)
+			}
+			dates, err := getParquetChangedDates(ctx, db.Database, &tt.state, tt.maxRowID)
+			if err != nil {
+				t.Fatalf("getParquetChangedDates() error = %v", err)
+			} else if !slices.Equal(dates, tt.wantDates) {
+				t.Errorf("getParquetChangedDates() = %v, want %v", dates, tt.wantDates)
+			}
+			pending, err := getParquetPendingRowIDs(ctx, db.Database, tt.maxRowID)
+			if err != nil {
+				t.Fatalf("getParquetPendingRowIDs() error = %v", err)
+			} else if !slices.Equal(pending, tt.wantPending) {
+				t.Errorf("getParquetPendingRowIDs() = %v, want %v", pending, tt.wantPending)
+			}
+		})
+	}
+}
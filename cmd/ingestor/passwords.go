@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/chzyer/readline"
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/util/random"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Parameters for new argon2id hashes, which are the first recommended option in the OWASP password storage cheat sheet.
+// They're on the lighter side since Basic auth verifies the password on every request.
+const (
+	argon2Memory      = 19 * 1024
+	argon2Iterations  = 2
+	argon2Parallelism = 1
+	argon2SaltLength  = 16
+	argon2KeyLength   = 32
+)
+
+const bcryptCost = 12
+
+var errUnsupportedHash = errors.New("unsupported password hash")
+
+// hashPassword hashes a password into a PHC string with the given algorithm ("argon2id" or "bcrypt").
+func hashPassword(password []byte, algorithm string) (string, error) {
+	switch algorithm {
+	case "argon2id":
+		salt := random.Bytes(argon2SaltLength)
+		key := argon2.IDKey(password, salt, argon2Iterations, argon2Memory, argon2Parallelism, argon2KeyLength)
+		return fmt.Sprintf(
+			"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, argon2Memory, argon2Iterations, argon2Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	case "bcrypt":
+		hash, err := bcrypt.GenerateFromPassword(password, bcryptCost)
+		return string(hash), err
+	default:
+		return "", fmt.Errorf("unknown algorithm %q, must be argon2id or bcrypt", algorithm)
+	}
+}
+
+type argon2Hash struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, fmt.Errorf("%w: malformed argon2id hash", errUnsupportedHash)
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, fmt.Errorf("%w: unsupported argon2 version %q", errUnsupportedHash, parts[2])
+	}
+	var parsed argon2Hash
+	_, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.iterations, &parsed.parallelism)
+	if err != nil || parsed.iterations == 0 || parsed.parallelism == 0 {
+		return nil, fmt.Errorf("%w: invalid argon2id parameters %q", errUnsupportedHash, parts[3])
+	}
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("%w: invalid argon2id salt", errUnsupportedHash)
+	} else if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return nil, fmt.Errorf("%w: invalid argon2id key", errUnsupportedHash)
+	}
+	return &parsed, nil
+}
+
+// isLegacyPasswordHash checks if the hash is an unsalted SHA-256 hash in base64 made by the old generate-password.py.
+func isLegacyPasswordHash(hash string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(hash)
+	return err == nil && len(decoded) == sha256.Size
+}
+
+// validatePasswordHash checks that a stored hash is in a supported format.
+func validatePasswordHash(hash string) error {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		_, err := parseArgon2Hash(hash)
+		return err
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		_, err := bcrypt.Cost([]byte(hash))
+		if err != nil {
+			return fmt.Errorf("%w: %w", errUnsupportedHash, err)
+		}
+		return nil
+	case isLegacyPasswordHash(hash):
+		return nil
+	default:
+		return errUnsupportedHash
+	}
+}
+
+// verifyPassword checks a password against a stored argon2id, bcrypt or legacy SHA-256 hash in constant time.
+func verifyPassword(hash string, password []byte) bool {
+	switch {
+	case strings.HasPrefix(hash, "$argon2id$"):
+		parsed, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key := argon2.IDKey(password, parsed.salt, parsed.iterations, parsed.memory, parsed.parallelism, uint32(len(parsed.key)))
+		return subtle.ConstantTimeCompare(key, parsed.key) == 1
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), password) == nil
+	case isLegacyPasswordHash(hash):
+		expected, _ := base64.StdEncoding.DecodeString(hash)
+		actual := sha256.Sum256(password)
+		return subtle.ConstantTimeCompare(actual[:], expected) == 1
+	default:
+		return false
+	}
+}
+
+// dummyPasswordHash is verified against for unknown users, so that response times don't reveal which users exist.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword(random.Bytes(16), "argon2id")
+	return hash
+})
+
+// verifiedPasswordCache remembers the last verified password of each user, so that clients using Basic auth
+// don't have to pay for a slow hash on every request. It only keeps a keyed hash of the password.
+type verifiedPasswordCache struct {
+	key    []byte
+	hashes map[string][]byte
+	lock   sync.RWMutex
+}
+
+func newVerifiedPasswordCache() *verifiedPasswordCache {
+	return &verifiedPasswordCache{key: random.Bytes(32), hashes: make(map[string][]byte)}
+}
+
+func (vpc *verifiedPasswordCache) mac(username string, password []byte) []byte {
+	h := hmac.New(sha256.New, vpc.key)
+	h.Write([]byte(username))
+	h.Write([]byte{0})
+	h.Write(password)
+	return h.Sum(nil)
+}
+
+func (vpc *verifiedPasswordCache) Check(username string, password []byte) bool {
+	vpc.lock.RLock()
+	cached, ok := vpc.hashes[username]
+	vpc.lock.RUnlock()
+	return ok && hmac.Equal(cached, vpc.mac(username, password))
+}
+
+func (vpc *verifiedPasswordCache) Add(username string, password []byte) {
+	mac := vpc.mac(username, password)
+	vpc.lock.Lock()
+	vpc.hashes[username] = mac
+	vpc.lock.Unlock()
+}
+
+// readPassword reads a password from the terminal, asking for it twice, or a single line from stdin if it's not a terminal.
+func readPassword() ([]byte, error) {
+	if !readline.DefaultIsTerminal() {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, fmt.Errorf("failed to read password from stdin: %w", err)
+		}
+		return []byte(strings.TrimRight(line, "\r\n")), nil
+	}
+	password, err := readline.Password("Password: ")
+	if err != nil {
+		return nil, err
+	}
+	confirm, err := readline.Password("Confirm password: ")
+	if err != nil {
+		return nil, err
+	} else if subtle.ConstantTimeCompare(password, confirm) != 1 {
+		return nil, fmt.Errorf("passwords don't match")
+	}
+	return password, nil
+}
+
+func cmdHashPassword(_ *gomuks.Gomuks, fs *CommandFlags) error {
+	algorithm := fs.MakeFull("a", "algorithm", "Hash algorithm: argon2id or bcrypt.", "argon2id").String()
+	username := fs.MakeFull("u", "user", "Print a full ACCESS_LIST entry for this username.", "").String()
+	if ok, err := fs.Parse(); !ok {
+		return err
+	} else if fs.NArg() > 0 {
+		return fmt.Errorf("the password is read from stdin, not arguments, to keep it out of shell history")
+	}
+	password, err := readPassword()
+	if err != nil {
+		return err
+	} else if len(password) == 0 {
+		return fmt.Errorf("password can't be empty")
+	}
+	hash, err := hashPassword(password, *algorithm)
+	if err != nil {
+		return err
+	}
+	if *username != "" {
+		fmt.Printf("%s:%s\n", *username, hash)
+	} else {
+		fmt.Println(hash)
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerifyPassword(t *testing.T) {
+	argon2Hash, err := hashPassword([]byte("hunter2"), "argon2id")
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	// The minimum cost keeps the test fast, verification reads the cost from the hash
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatalf("failed to hash password: %v", err)
+	}
+	legacySum := sha256.Sum256([]byte("hunter2"))
+	legacyHash := base64.StdEncoding.EncodeToString(legacySum[:])
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		want     bool
+	}{
+		{"argon2id", argon2Hash, "hunter2", true},
+		{"argon2id wrong password", argon2Hash, "hunter3", false},
+		{"argon2id truncated", argon2Hash[:strings.LastIndex(argon2Hash, "$")], "hunter2", false},
+		{"bcrypt", string(bcryptHash), "hunter2", true},
+		{"bcrypt wrong password", string(bcryptHash), "hunter3", false},
+		{"legacy SHA-256", legacyHash, "hunter2", true},
+		{"legacy SHA-256 wrong password", legacyHash, "hunter3", false},
+		{"plaintext", "hunter2", "hunter2", false},
+		{"empty hash", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := verifyPassword(tt.hash, []byte(tt.password)); got != tt.want {
+				t.Errorf("verifyPassword() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePasswordHash(t *testing.T) {
+	tests := []struct {
+		name    string
+		hash    string
+		wantErr bool
+	}{
+		{"argon2id", "$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2V5a2U", false},
+		{"argon2id old version", "$argon2id$v=16$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5", true},
+		{"argon2id zero iterations", "$argon2id$v=19$m=19456,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5", true},
+		{"argon2id bad salt", "$argon2id$v=19$m=19456,t=2,p=1$!!!$a2V5a2V5a2V5", true},
+		{"argon2id missing key", "$argon2id$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$", true},
+		{"argon2i", "$argon2i$v=19$m=19456,t=2,p=1$c2FsdHNhbHRzYWx0c2FsdA$a2V5a2V5a2V5", true},
+		{"bcrypt", "$2b$12$R9h/cIPz0gi.URNNX3kh2OPST9/PgBkqquzi.Ss7KIUgO2t0jWMUW", false},
+		{"bcrypt malformed", "$2b$12$short", true},
+		{"legacy SHA-256", "9S+9MrKzuG/4jvbEkGKChfSCrxXdyylUH5S89Saj9sc=", false},
+		{"SHA-1 length", "9S+9MrKzuG/4jvbEkGKChfSCrxU=", true},
+		{"plaintext", "hunter2", true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validatePasswordHash(tt.hash)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validatePasswordHash() error = %v, wantErr %t", err, tt.wantErr)
+			} else if err != nil && !errors.Is(err, errUnsupportedHash) {
+				t.Errorf("validatePasswordHash() error = %v, want errUnsupportedHash", err)
+			}
+		})
+	}
+}
+
+func TestHashPasswordRoundTrip(t *testing.T) {
+	for _, algorithm := range []string{"argon2id", "bcrypt"} {
+		t.Run(algorithm, func(t *testing.T) {
+			hash, err := hashPassword([]byte("correct horse"), algorithm)
+			if err != nil {
+				t.Fatalf("hashPassword() error = %v", err)
+			} else if err = validatePasswordHash(hash); err != nil {
+				t.Errorf("validatePasswordHash() of new hash error = %v", err)
+			} else if !verifyPassword(hash, []byte("correct horse")) {
+				t.Error("verifyPassword() rejected the hashed password")
+			}
+		})
+	}
+	if _, err := hashPassword([]byte("x"), "md5"); err == nil {
+		t.Error("hashPassword() with unknown algorithm didn't fail")
+	}
+}
+
+func TestVerifiedPasswordCache(t *testing.T) {
+	vpc := newVerifiedPasswordCache()
+	if vpc.Check("alice", []byte("hunter2")) {
+		t.Fatal("empty cache matched a password")
+	}
+	vpc.Add("alice", []byte("hunter2"))
+	if !vpc.Check("alice", []byte("hunter2")) {
+		t.Error("cache didn't match the added password")
+	}
+	if vpc.Check("alice", []byte("hunter3")) {
+		t.Error("cache matched a different password")
+	}
+	if vpc.Check("bob", []byte("hunter2")) {
+		t.Error("cache matched the password for a different user")
+	}
+}
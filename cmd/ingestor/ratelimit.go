@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// RateLimitConfig configures the per-user token buckets. Requests spend tokens according to their cost.
+type RateLimitConfig struct {
+	// PerSecond is how many tokens each user gets back per second, 0 disables rate limiting.
+	PerSecond float64 `yaml:"per_second"`
+	// Burst is the size of the bucket, i.e. the largest total cost a user can spend at once.
+	Burst float64 `yaml:"burst"`
+}
+
+func (cfg *RateLimitConfig) applyEnv() error {
+	return errors.Join(
+		envFloat("RATE_LIMIT_PER_SECOND", &cfg.PerSecond),
+		envFloat("RATE_LIMIT_BURST", &cfg.Burst),
+	)
+}
+
+func (cfg *RateLimitConfig) validate() error {
+	if cfg.PerSecond < 0 || math.IsInf(cfg.PerSecond, 0) || math.IsNaN(cfg.PerSecond) {
+		return fmt.Errorf("per_second must be a non-negative number")
+	} else if cfg.Burst < 1 || math.IsInf(cfg.Burst, 0) || math.IsNaN(cfg.Burst) {
+		return fmt.Errorf("burst must be at least 1")
+	}
+	return nil
+}
+
+// Request costs in tokens. Reading the database is the expensive part of every endpoint,
+// so the costs roughly follow how many rows a request can read.
+const (
+	costBase = 1
+	// costPer100Messages is added to searches for every 100 messages of the limit.
+	costPer100Messages = 1
+	// costExportRoom is the cost of streaming the full history of a room.
+	costExportRoom = 25
+	// costArchiveRoom is the cost of each room in an archive, which is doubled if media is included.
+	costArchiveRoom = 25
+	// costKeyFile is the cost of exporting or importing room keys, which derives the file key from the passphrase
+	// with hundreds of thousands of PBKDF2 rounds.
+	costKeyFile = 25
+)
+
+// RequestCost calculates how many tokens a request spends.
+type RequestCost func(r *http.Request) float64
+
+func fixedCost(cost float64) RequestCost {
+	return func(r *http.Request) float64 {
+		return cost
+	}
+}
+
+func (ab *BeeperIngestor) searchMessagesCost(r *http.Request) float64 {
+	limits := ab.Config().Limits
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = limits.DefaultSearchLimit
+	}
+	return costBase + costPer100Messages*math.Ceil(float64(min(limit, limits.MaxSearchLimit))/100)
+}
+
+func archiveCost(r *http.Request) float64 {
+	query := r.URL.Query()
+	cost := float64(costArchiveRoom * max(1, len(query["room_id"])))
+	if query.Get("media") != "false" {
+		cost *= 2
+	}
+	return costBase + cost
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// RateLimiter keeps a token bucket for each API user.
+type RateLimiter struct {
+	config  RateLimitConfig
+	buckets map[string]*tokenBucket
+	lock    sync.Mutex
+}
+
+func NewRateLimiter(config RateLimitConfig) *RateLimiter {
+	return &RateLimiter{config: config, buckets: make(map[string]*tokenBucket)}
+}
+
+// Take spends tokens from the user's bucket. It returns whether the request is allowed, how many tokens are left,
+// and if it's not allowed, how long until it would be. Requests that cost more than the burst size are charged
+// the burst size, so that they're possible at all.
+func (rl *RateLimiter) Take(username string, cost float64) (ok bool, remaining float64, retryAfter time.Duration) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	return rl.take(username, cost)
+}
+
+func (rl *RateLimiter) take(username string, cost float64) (ok bool, remaining float64, retryAfter time.Duration) {
+	cost = min(cost, rl.config.Burst)
+	now := time.Now()
+	bucket, exists := rl.buckets[username]
+	if !exists {
+		bucket = &tokenBucket{tokens: rl.config.Burst, updated: now}
+		rl.buckets[username] = bucket
+	}
+	bucket.tokens = min(rl.config.Burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*rl.config.PerSecond)
+	bucket.updated = now
+	if bucket.tokens < cost {
+		return false, bucket.tokens, rl.timeToRefill(cost - bucket.tokens)
+	}
+	bucket.tokens -= cost
+	return true, bucket.tokens, 0
+}
+
+// SetConfig replaces the rate limit settings. Buckets are kept, but won't hold more than the new burst size.
+func (rl *RateLimiter) SetConfig(config RateLimitConfig) {
+	rl.lock.Lock()
+	rl.config = config
+	rl.lock.Unlock()
+}
+
+func (rl *RateLimiter) timeToRefill(tokens float64) time.Duration {
+	return time.Duration(tokens / rl.config.PerSecond * float64(time.Second))
+}
+
+// ceilSeconds rounds a duration up to whole seconds for headers like Retry-After.
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int((d + time.Second - 1) / time.Second))
+}
+
+// rateLimit wraps a handler so that it spends tokens from the API user's bucket,
+// responding with 429 Too Many Requests if there aren't enough.
+func (rl *RateLimiter) rateLimit(cost RequestCost, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := apiUserFromContext(r.Context())
+		requestCost := cost(r)
+		rl.lock.Lock()
+		if rl.config.PerSecond == 0 {
+			rl.lock.Unlock()
+			handler(w, r)
+			return
+		}
+		ok, remaining, retryAfter := rl.take(user.Name, requestCost)
+		burst := rl.config.Burst
+		reset := rl.timeToRefill(burst - remaining)
+		rl.lock.Unlock()
+		w.Header().Set("RateLimit-Limit", strconv.FormatFloat(burst, 'f', -1, 64))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(int(remaining)))
+		w.Header().Set("RateLimit-Reset", ceilSeconds(reset))
+		w.Header().Set("RateLimit-Cost", strconv.FormatFloat(requestCost, 'f', -1, 64))
+		if !ok {
+			hlog.FromRequest(r).Debug().
+				Str("username", user.Name).
+				Float64("cost", requestCost).
+				Float64("remaining", remaining).
+				Msg("Rate limited request")
+			writeError(w, r, errRetryAfter(w, "Rate limit exceeded", retryAfter))
+			return
+		}
+		handler(w, r)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	"go.mau.fi/util/dbutil"
+	"maunium.net/go/mautrix/id"
+)
+
+// getRoomNetworksQuery finds the bridge protocol of every bridged room from its m.bridge (or legacy uk.half-shot.bridge) state.
+const getRoomNetworksQuery = `
+	SELECT current_state.room_id, MIN(event.content ->> '$.protocol.id')
+	FROM current_state
+	JOIN event ON event.rowid = current_state.event_rowid
+	WHERE current_state.event_type IN ('m.bridge', 'uk.half-shot.bridge')
+	  AND event.content ->> '$.protocol.id' IS NOT NULL
+	GROUP BY current_state.room_id
+`
+
+type roomNetwork struct {
+	RoomID  id.RoomID
+	Network string
+}
+
+// GetRoomNetworks returns the bridge network (e.g. "whatsapp") of each bridged room.
+// Rooms that aren't bridged are not included in the map.
+func (ab *BeeperIngestor) GetRoomNetworks(ctx context.Context) (map[id.RoomID]string, error) {
+	rows, err := ab.gmx.Client.DB.Query(ctx, getRoomNetworksQuery)
+	return dbutil.RowIterAsMap(
+		dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (rn roomNetwork, err error) {
+			var network sql.NullString
+			err = row.Scan(&rn.RoomID, &network)
+			rn.Network = network.String
+			return
+		}, err),
+		func(rn roomNetwork) (id.RoomID, string) {
+			return rn.RoomID, rn.Network
+		},
+	)
+}
+
+const (
+	getAllRoomIDsQuery = `SELECT room_id FROM room`
+	// getDirectChatsQuery flattens the m.direct account data (user ID -> list of room IDs) into room IDs.
+	getDirectChatsQuery = `
+		SELECT DISTINCT rooms.value
+		FROM account_data, json_each(account_data.content) AS users, json_each(users.value) AS rooms
+		WHERE account_data.user_id = $1 AND account_data.type = 'm.direct'
+	`
+	// getSpaceChildrenQuery finds the children of every space. Removed children have an m.space.child event without via.
+	getSpaceChildrenQuery = `
+		SELECT current_state.room_id, current_state.state_key
+		FROM current_state
+		JOIN event ON event.rowid = current_state.event_rowid
+		WHERE current_state.event_type = 'm.space.child' AND json_type(event.content, '$.via') = 'array'
+	`
+)
+
+func (ab *BeeperIngestor) GetAllRoomIDs(ctx context.Context) ([]id.RoomID, error) {
+	rows, err := ab.gmx.Client.DB.Query(ctx, getAllRoomIDsQuery)
+	return dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[id.RoomID], err).AsList()
+}
+
+// GetDirectChats returns the set of rooms that are marked as DMs in the m.direct account data of the account.
+func (ab *BeeperIngestor) GetDirectChats(ctx context.Context) (map[id.RoomID]struct{}, error) {
+	if ab.gmx.Client.Account == nil {
+		return map[id.RoomID]struct{}{}, nil
+	}
+	rows, err := ab.gmx.Client.DB.Query(ctx, getDirectChatsQuery, ab.gmx.Client.Account.UserID)
+	return dbutil.RowIterAsMap(
+		dbutil.NewRowIterWithError(rows, dbutil.ScanSingleColumn[id.RoomID], err),
+		func(roomID id.RoomID) (id.RoomID, struct{}) {
+			return roomID, struct{}{}
+		},
+	)
+}
+
+type spaceChild struct {
+	SpaceID id.RoomID
+	ChildID id.RoomID
+}
+
+// GetSpaceChildren returns the direct children of every space, keyed by the space room ID.
+func (ab *BeeperIngestor) GetSpaceChildren(ctx context.Context) (map[id.RoomID][]id.RoomID, error) {
+	rows, err := ab.gmx.Client.DB.Query(ctx, getSpaceChildrenQuery)
+	children := make(map[id.RoomID][]id.RoomID)
+	err = dbutil.NewRowIterWithError(rows, func(row dbutil.Scannable) (sc spaceChild, err error) {
+		err = row.Scan(&sc.SpaceID, &sc.ChildID)
+		return
+	}, err).Iter(func(sc spaceChild) (bool, error) {
+		children[sc.SpaceID] = append(children[sc.SpaceID], sc.ChildID)
+		return true, nil
+	})
+	return children, err
+}
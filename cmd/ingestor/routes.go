@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// apiRoute is an authenticated API endpoint. The same table is used to register the handlers and to generate
+// the OpenAPI document, so that the document always matches what the router serves.
+//
+// API routes are versioned under /v1/. Breaking changes to request or response shapes go in a new version,
+// with the old routes kept as deprecated aliases for a while. Operational endpoints like /metrics aren't versioned.
+type apiRoute struct {
+	// Method is empty for routes that accept any method. They're documented as GET.
+	Method string
+	Path   string
+	// Endpoint is the name of the endpoint in the endpoints section of the config.
+	Endpoint string
+	Scope    Scope
+	// Cost is the rate limit cost of a request, nil if the route isn't rate limited.
+	Cost    RequestCost
+	Handler http.HandlerFunc
+	Doc     apiDoc
+	// Successor is the path that replaces a deprecated route. Responses of deprecated routes have Deprecation
+	// and Link headers pointing to it.
+	Successor string
+}
+
+// apiDoc is the OpenAPI description of a route.
+type apiDoc struct {
+	ID          string
+	Tag         string
+	Summary     string
+	Description string
+	Params      []apiParam
+	// Request is a value of the JSON request body type, or nil if the route doesn't take a body.
+	Request any
+	// Response is a value of the JSON response type, or nil if the response isn't JSON.
+	Response any
+	// ContentType is the type of non-JSON responses. If Response is set too, the response is a stream of them.
+	ContentType string
+	// Errors are the status codes that the route can respond with in addition to the ones of every route.
+	Errors []int
+}
+
+// apiParam is a query or path parameter of a route.
+type apiParam struct {
+	Name string
+	// In is "query" or "path".
+	In          string
+	Type        string
+	Description string
+	Required    bool
+	// Repeated parameters can be given more than once.
+	Repeated bool
+}
+
+// deprecatedAt is when the unversioned routes were deprecated, for the Deprecation header.
+var deprecatedAt = time.Date(2026, time.October, 18, 0, 0, 0, 0, time.UTC)
+
+func (ab *BeeperIngestor) apiRoutes() []*apiRoute {
+	roomIDPathParam := apiParam{Name: "roomID", In: "path", Type: "string", Description: "Matrix room ID", Required: true}
+	roomIDQueryParam := apiParam{Name: "room_id", In: "query", Type: "string", Description: "Filter messages by room ID"}
+	searchParams := []apiParam{
+		{Name: "sender", In: "query", Type: "string", Description: "Filter messages by sender. The @ prefix is added if missing, the domain is required"},
+		{Name: "before", In: "query", Type: "integer", Description: "Only messages before this timestamp (milliseconds since epoch)"},
+		{Name: "after", In: "query", Type: "integer", Description: "Only messages after this timestamp (milliseconds since epoch)"},
+		{Name: "limit", In: "query", Type: "integer", Description: "Maximum number of messages to return, capped to limits.max_search_limit"},
+		{Name: "cursor", In: "query", Type: "string", Description: "Pagination cursor from oldest_cursor or newest_cursor of a previous page"},
+		{Name: "direction", In: "query", Type: "string", Description: "Pagination direction, before or after, required with cursor"},
+	}
+	return []*apiRoute{{
+		Method:   http.MethodGet,
+		Path:     "/v1/messages",
+		Endpoint: EndpointSearchMessages,
+		Scope:    ScopeMessagesRead,
+		Cost:     ab.searchMessagesCost,
+		Handler:  ab.SearchMessages,
+		Doc: apiDoc{
+			ID:          "searchMessages",
+			Tag:         "Messages",
+			Summary:     "Search messages",
+			Description: "Search for messages with various filters, newest first.",
+			Params:      append([]apiParam{roomIDQueryParam}, searchParams...),
+			Response:    &PaginatedMessagesWithCursors{},
+			Errors:      []int{http.StatusBadRequest},
+		},
+	}, {
+		Path:      "/search-messages",
+		Endpoint:  EndpointSearchMessages,
+		Scope:     ScopeMessagesRead,
+		Cost:      ab.searchMessagesCost,
+		Handler:   ab.SearchMessages,
+		Successor: "/v1/messages",
+		Doc: apiDoc{
+			ID:       "searchMessagesDeprecated",
+			Tag:      "Messages",
+			Summary:  "Search messages",
+			Params:   append([]apiParam{roomIDQueryParam}, searchParams...),
+			Response: &PaginatedMessagesWithCursors{},
+			Errors:   []int{http.StatusBadRequest},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/rooms/{roomID}/messages",
+		Endpoint: EndpointSearchMessages,
+		Scope:    ScopeMessagesRead,
+		Cost:     ab.searchMessagesCost,
+		Handler:  ab.SearchMessages,
+		Doc: apiDoc{
+			ID:          "searchRoomMessages",
+			Tag:         "Messages",
+			Summary:     "Search messages in a room",
+			Description: "Search for messages in one room with various filters, newest first.",
+			Params:      append([]apiParam{roomIDPathParam}, searchParams...),
+			Response:    &PaginatedMessagesWithCursors{},
+			Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/rooms/{roomID}/messages/{eventID}",
+		Endpoint: EndpointSearchMessages,
+		Scope:    ScopeMessagesRead,
+		Cost:     fixedCost(costBase),
+		Handler:  ab.GetMessage,
+		Doc: apiDoc{
+			ID:      "getMessage",
+			Tag:     "Messages",
+			Summary: "Get a message",
+			Params: []apiParam{
+				roomIDPathParam,
+				{Name: "eventID", In: "path", Type: "string", Description: "Matrix event ID of the message", Required: true},
+			},
+			Response: &Message{},
+			Errors:   []int{http.StatusNotFound},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/rooms/{roomID}/export",
+		Endpoint: EndpointExportRoom,
+		Scope:    ScopeMessagesRead,
+		Cost:     fixedCost(costExportRoom),
+		Handler:  ab.ExportRoom,
+		Doc: apiDoc{
+			ID:          "exportRoom",
+			Tag:         "Messages",
+			Summary:     "Export room history",
+			Description: "Stream every message in a room in chronological order as newline-delimited JSON, one message per line.",
+			Params: []apiParam{
+				roomIDPathParam,
+				{Name: "format", In: "query", Type: "string", Description: "Output format, only ndjson is supported"},
+			},
+			Response:    &Message{},
+			ContentType: "application/x-ndjson",
+			Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/archive",
+		Endpoint: EndpointArchive,
+		Scope:    ScopeMessagesRead,
+		Cost:     archiveCost,
+		Handler:  ab.ExportArchive,
+		Doc: apiDoc{
+			ID:          "exportArchive",
+			Tag:         "Messages",
+			Summary:     "Download a chat archive",
+			Description: "Download a zip archive with HTML transcripts and media of one or more rooms. Also requires the media:read scope unless media is false.",
+			Params: []apiParam{
+				{Name: "room_id", In: "query", Type: "string", Description: "Room to include in the archive", Required: true, Repeated: true},
+				{Name: "media", In: "query", Type: "boolean", Description: "Set to false to skip downloading media"},
+			},
+			ContentType: "application/zip",
+			Errors:      []int{http.StatusBadRequest, http.StatusNotFound},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/backfill",
+		Endpoint: EndpointBackfill,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costBase),
+		Handler:  ab.GetBackfillStatus,
+		Doc: apiDoc{
+			ID:       "getBackfillStatus",
+			Tag:      "Admin",
+			Summary:  "Get backfill progress",
+			Response: &BackfillStatusResponse{},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/backfill/{roomID}",
+		Endpoint: EndpointBackfill,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costBase),
+		Handler:  ab.GetBackfillStatus,
+		Doc: apiDoc{
+			ID:       "getRoomBackfillStatus",
+			Tag:      "Admin",
+			Summary:  "Get backfill progress of a room",
+			Params:   []apiParam{roomIDPathParam},
+			Response: &BackfillStatusResponse{},
+			Errors:   []int{http.StatusNotFound},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/admin/audit",
+		Endpoint: EndpointAuditLog,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costBase),
+		Handler:  ab.GetAuditLog,
+		Doc: apiDoc{
+			ID:          "getAuditLog",
+			Tag:         "Admin",
+			Summary:     "Query the audit log",
+			Description: "Get audit log entries of API requests, newest first.",
+			Params: []apiParam{
+				{Name: "username", In: "query", Type: "string", Description: "Only requests by this API user"},
+				{Name: "path", In: "query", Type: "string", Description: "Only requests to this path"},
+				{Name: "room_id", In: "query", Type: "string", Description: "Only requests that returned data from this room"},
+				{Name: "since", In: "query", Type: "integer", Description: "Only requests at or after this timestamp (milliseconds since epoch)"},
+				{Name: "until", In: "query", Type: "integer", Description: "Only requests before this timestamp (milliseconds since epoch)"},
+				{Name: "limit", In: "query", Type: "integer", Description: "Maximum number of entries to return, at most 1000"},
+				{Name: "cursor", In: "query", Type: "string", Description: "next_cursor from the previous page"},
+			},
+			Response: &AuditLogResponse{},
+			Errors:   []int{http.StatusBadRequest},
+		},
+	}, {
+		Method:   http.MethodPost,
+		Path:     "/v1/admin/verify",
+		Endpoint: EndpointEncryption,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costBase),
+		Handler:  ab.VerifyDevice,
+		Doc: apiDoc{
+			ID:      "verifyDevice",
+			Tag:     "Admin",
+			Summary: "Verify the device with a recovery key",
+			Description: "Verify the ingestor's device with the recovery key of the account's secret storage and restore " +
+				"the server-side key backup, so that the ingestor can decrypt old messages. Starts syncing if the " +
+				"ingestor was waiting for verification.",
+			Request:  &VerifyRequest{},
+			Response: &VerifyResponse{},
+			Errors:   []int{http.StatusBadRequest, http.StatusServiceUnavailable},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/me",
+		Endpoint: EndpointEncryption,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costBase),
+		Handler:  ab.GetMe,
+		Doc: apiDoc{
+			ID:      "getMe",
+			Tag:     "Admin",
+			Summary: "Get the account and device status",
+			Description: "Get the logged-in account and device with its encryption health: verification, cross-signing, " +
+				"key backup and one-time keys. The device name, key backup and one-time key counts are fetched from the homeserver.",
+			Response: &MeResponse{},
+			Errors:   []int{http.StatusServiceUnavailable},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/v1/admin/decryption-failures",
+		Endpoint: EndpointEncryption,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costBase),
+		Handler:  ab.GetDecryptionFailures,
+		Doc: apiDoc{
+			ID:      "getDecryptionFailures",
+			Tag:     "Admin",
+			Summary: "Report messages that failed to decrypt",
+			Description: "Get the stored events that couldn't be decrypted, grouped by room and megolm session. " +
+				"Decryption is retried automatically when the sessions arrive.",
+			Params:   []apiParam{{Name: "room_id", In: "query", Type: "string", Description: "Only failures in this room"}},
+			Response: &DecryptionFailuresResponse{},
+			Errors:   []int{http.StatusNotFound},
+		},
+	}, {
+		Method:   http.MethodPost,
+		Path:     "/v1/admin/keys/export",
+		Endpoint: EndpointEncryption,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costKeyFile),
+		Handler:  ab.ExportRoomKeys,
+		Doc: apiDoc{
+			ID:      "exportRoomKeys",
+			Tag:     "Admin",
+			Summary: "Export room keys",
+			Description: "Download the megolm sessions of the ingestor as a key export file encrypted with the passphrase, " +
+				"in the standard format that other ingestors and Matrix clients can import. The time range selects " +
+				"the sessions of messages sent in it. The passphrase is in the body rather than the query to keep it out of logs.",
+			Request:     &RoomKeyExportRequest{},
+			ContentType: "text/plain",
+			Errors:      []int{http.StatusBadRequest, http.StatusNotFound, http.StatusServiceUnavailable},
+		},
+	}, {
+		Method:   http.MethodPost,
+		Path:     "/v1/admin/keys/import",
+		Endpoint: EndpointEncryption,
+		Scope:    ScopeAdmin,
+		Cost:     fixedCost(costKeyFile),
+		Handler:  ab.ImportRoomKeys,
+		Doc: apiDoc{
+			ID:      "importRoomKeys",
+			Tag:     "Admin",
+			Summary: "Import room keys",
+			Description: "Import a key export file, such as one exported from another ingestor or a Matrix client. " +
+				"Sessions that the ingestor already has from an equal or earlier message index are skipped, and " +
+				"decryption of stored messages is retried for the imported ones.",
+			Request:  &RoomKeyImportRequest{},
+			Response: &RoomKeyImportResponse{},
+			Errors:   []int{http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusServiceUnavailable},
+		},
+	}, {
+		Method:   http.MethodGet,
+		Path:     "/metrics",
+		Endpoint: EndpointMetrics,
+		Scope:    ScopeAdmin,
+		Handler:  ab.metrics.Handler().ServeHTTP,
+		Doc: apiDoc{
+			ID:          "getMetrics",
+			Tag:         "Admin",
+			Summary:     "Prometheus metrics",
+			ContentType: "text/plain",
+		},
+	}}
+}
+
+// registerRoutes adds the API routes to the router with their scope checks, rate limits and config switches.
+func (ab *BeeperIngestor) registerRoutes(router *http.ServeMux) {
+	for _, route := range ab.apiRoutes() {
+		handler := route.Handler
+		if route.Cost != nil {
+			handler = ab.rateLimiter.rateLimit(route.Cost, handler)
+		}
+		pattern := route.Path
+		if route.Method != "" {
+			pattern = route.Method + " " + pattern
+		}
+		if route.Successor != "" {
+			handler = deprecated(route.Successor, handler)
+		}
+		router.HandleFunc(pattern, ab.endpoint(route.Endpoint, requireScope(route.Scope, handler)))
+	}
+}
+
+// deprecated adds the Deprecation header of RFC 9745 and a link to the successor route to responses.
+func deprecated(successor string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecatedAt.Unix()))
+		w.Header().Set("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, successor))
+		handler(w, r)
+	}
+}
@@ -10,6 +10,7 @@ import (
 
 	"github.com/rs/zerolog/hlog"
 	"go.mau.fi/gomuks/pkg/hicli/database"
+	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/id"
 )
 
@@ -34,6 +35,20 @@ type PaginatedMessagesWithCursors struct {
 	NewestCursor string    `json:"newest_cursor"`
 }
 
+// messageEventBaseQuery selects events in the column order expected by database.Event.Scan
+const messageEventBaseQuery = `
+		SELECT event.rowid, COALESCE(timeline.rowid, 0) as timeline_rowid,
+		       event.room_id, event_id, sender, type, state_key, timestamp, content, decrypted, decrypted_type,
+		       unsigned, local_content, transaction_id, redacted_by, relates_to, relation_type,
+		       megolm_session_id, decryption_error, send_error, reactions, last_edit_rowid, unread_type
+		FROM event
+		LEFT JOIN timeline ON event.rowid = timeline.event_rowid`
+
+// messageEventCondition matches the events that are returned as messages: plaintext and decrypted messages,
+// and encrypted events that failed to decrypt, which are flagged as errored because their type isn't known.
+const messageEventCondition = `(event.type = 'm.room.message' OR event.decrypted_type = 'm.room.message' OR
+		(event.type = 'm.room.encrypted' AND event.decrypted IS NULL AND event.decryption_error IS NOT NULL))`
+
 // SearchMessagesQuery represents search parameters for message queries
 
 type SearchMessagesQuery struct {
@@ -44,11 +59,13 @@ type SearchMessagesQuery struct {
 	Limit     int
 	Cursor    database.EventRowID
 	Direction string // "before" or "after"
+	// RoomFilter limits the search to the rooms the API user can access, nil means all rooms
+	RoomFilter RoomFilter
 }
 
 // SearchMessages searches for messages with the given parameters
 func (ab *BeeperIngestor) SearchMessagesDatabaseQuery(ctx context.Context, params SearchMessagesQuery) ([]*database.Event, error) {
-	conditions := []string{"(event.type = 'm.room.message' OR event.decrypted_type = 'm.room.message')"}
+	conditions := []string{messageEventCondition}
 	args := make([]any, 0)
 
 	if params.RoomID != "" {
@@ -56,6 +73,15 @@ func (ab *BeeperIngestor) SearchMessagesDatabaseQuery(ctx context.Context, param
 		args = append(args, params.RoomID)
 	}
 
+	if params.RoomFilter != nil {
+		roomIDs, err := json.Marshal(params.RoomFilter)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, "event.room_id IN (SELECT value FROM json_each($"+strconv.Itoa(len(args)+1)+"))")
+		args = append(args, string(roomIDs))
+	}
+
 	if params.Sender != "" {
 		conditions = append(conditions, "event.sender = $"+strconv.Itoa(len(args)+1))
 		args = append(args, params.Sender)
@@ -80,13 +106,7 @@ func (ab *BeeperIngestor) SearchMessagesDatabaseQuery(ctx context.Context, param
 		args = append(args, params.Cursor)
 	}
 
-	query := `
-		SELECT event.rowid, COALESCE(timeline.rowid, 0) as timeline_rowid,
-		       event.room_id, event_id, sender, type, state_key, timestamp, content, decrypted, decrypted_type,
-		       unsigned, local_content, transaction_id, redacted_by, relates_to, relation_type,
-		       megolm_session_id, decryption_error, send_error, reactions, last_edit_rowid, unread_type
-		FROM event
-		LEFT JOIN timeline ON event.rowid = timeline.event_rowid
+	query := messageEventBaseQuery + `
 		WHERE ` + strings.Join(conditions, " AND ") + `
 		ORDER BY event.timestamp DESC, event.rowid DESC
 		LIMIT $` + strconv.Itoa(len(args)+1)
@@ -99,9 +119,15 @@ func (ab *BeeperIngestor) SearchMessagesDatabaseQuery(ctx context.Context, param
 
 func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request) {
 	log := hlog.FromRequest(r)
+	cfg := ab.Config()
 	query := &SearchMessagesQueryParams{
 		RoomID: r.URL.Query().Get("room_id"),
-		Limit:  100, // Default limit
+		Limit:  cfg.Limits.DefaultSearchLimit,
+	}
+	// The room-scoped route takes the room from the path instead of the query
+	roomFromPath := r.PathValue("roomID") != ""
+	if roomFromPath {
+		query.RoomID = r.PathValue("roomID")
 	}
 
 	// Handle sender with proper Matrix UserID parsing
@@ -112,7 +138,7 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 		}
 		// Basic Matrix ID validation: @user:domain
 		if !strings.Contains(senderStr, ":") {
-			http.Error(w, "Invalid sender user ID format", http.StatusBadRequest)
+			writeError(w, r, errInvalidParam("sender", "Invalid sender user ID format"))
 			return
 		}
 		query.Sender = senderStr
@@ -122,17 +148,17 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
 		limit, err := strconv.Atoi(limitStr)
 		if err != nil || limit <= 0 {
-			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			writeError(w, r, errInvalidParam("limit", "Invalid limit parameter"))
 			return
 		}
-		query.Limit = limit
+		query.Limit = min(limit, cfg.Limits.MaxSearchLimit)
 	}
 
 	// Parse before/after timestamps if provided
 	if beforeStr := r.URL.Query().Get("before"); beforeStr != "" {
 		before, err := strconv.ParseInt(beforeStr, 10, 64)
 		if err != nil {
-			http.Error(w, "Invalid before timestamp", http.StatusBadRequest)
+			writeError(w, r, errInvalidParam("before", "Invalid before timestamp"))
 			return
 		}
 		query.Before = before
@@ -141,7 +167,7 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 	if afterStr := r.URL.Query().Get("after"); afterStr != "" {
 		after, err := strconv.ParseInt(afterStr, 10, 64)
 		if err != nil {
-			http.Error(w, "Invalid after timestamp", http.StatusBadRequest)
+			writeError(w, r, errInvalidParam("after", "Invalid after timestamp"))
 			return
 		}
 		query.After = after
@@ -151,7 +177,7 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 	if cursor := r.URL.Query().Get("cursor"); cursor != "" {
 		direction := r.URL.Query().Get("direction")
 		if direction != "before" && direction != "after" {
-			http.Error(w, "Invalid pagination direction, must be 'before' or 'after'", http.StatusBadRequest)
+			writeError(w, r, errInvalidParam("direction", "Invalid pagination direction, must be 'before' or 'after'"))
 			return
 		}
 		query.Pagination = &PaginationArg{
@@ -160,19 +186,28 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 		}
 	}
 
+	roomFilter, ok := ab.requestRoomFilter(w, r)
+	if !ok {
+		return
+	} else if roomFromPath && !roomFilter.Allows(id.RoomID(query.RoomID)) {
+		writeError(w, r, errNoSuchRoom("roomID"))
+		return
+	}
+
 	searchParams := SearchMessagesQuery{
-		RoomID:    id.RoomID(query.RoomID),
-		Sender:    id.UserID(query.Sender),
-		Before:    query.Before,
-		After:     query.After,
-		Limit:     max(1, min(query.Limit, 1000)),
-		Direction: "before",
+		RoomID:     id.RoomID(query.RoomID),
+		Sender:     id.UserID(query.Sender),
+		Before:     query.Before,
+		After:      query.After,
+		Limit:      query.Limit,
+		Direction:  "before",
+		RoomFilter: roomFilter,
 	}
 
 	if query.Pagination != nil {
 		cursor, err := strconv.ParseInt(query.Pagination.Cursor, 10, 64)
 		if err != nil {
-			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			writeError(w, r, errInvalidParam("cursor", "Invalid cursor"))
 			return
 		}
 		searchParams.Cursor = database.EventRowID(cursor)
@@ -182,7 +217,7 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 	events, err := ab.SearchMessagesDatabaseQuery(r.Context(), searchParams)
 	if err != nil {
 		log.Err(err).Msg("Failed to query timeline")
-		http.Error(w, "Failed to query timeline", http.StatusInternalServerError)
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to query timeline"))
 		return
 	}
 
@@ -217,50 +252,7 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 
 	for i, event := range events {
 		if i < query.Limit {
-			message := Message{
-				URL:       fmt.Sprintf("https://matrix.to/#/%s/%s", event.RoomID, event.ID),
-				Timestamp: event.Timestamp,
-				SenderID:  event.Sender.String(),
-				ID:        string(event.ID),
-				RoomInfo: &RoomInfo{
-					ID:  string(event.RoomID),
-					URL: fmt.Sprintf("https://matrix.to/#/%s", event.RoomID),
-				},
-			}
-
-			// Set room name from room info if available
-			if room := roomInfoMap[event.RoomID]; room != nil && room.Name != nil {
-				message.RoomInfo.Name = *room.Name
-			} else {
-				message.RoomInfo.Name = string(event.RoomID)
-			}
-
-			if event.LocalContent != nil && event.LocalContent.SanitizedHTML != "" {
-				message.Text = event.LocalContent.SanitizedHTML
-			} else {
-				var content struct {
-					Body string `json:"body"`
-				}
-				var rawContent []byte
-				if event.LocalContent != nil && event.LocalContent.WasPlaintext || event.DecryptedType == "m.room.message" {
-					rawContent = event.Decrypted
-				} else {
-					rawContent = event.Content
-				}
-				if err := json.Unmarshal(rawContent, &content); err == nil {
-					message.Text = content.Body
-				} else {
-					message.Text = string(rawContent)
-				}
-			}
-			var unsigned struct {
-				Age     int `json:"age"`
-				HSOrder int `json:"com.beeper.hs.order"`
-			}
-			if err := json.Unmarshal(event.Unsigned, &unsigned); err == nil {
-				message.SortKey = unsigned.HSOrder
-			}
-			messages = append(messages, message)
+			messages = append(messages, ab.eventToMessage(event, roomInfoMap[event.RoomID]))
 
 			// Track cursors
 			if oldestRowID == "" {
@@ -272,6 +264,12 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 
 	hasMore := len(events) > query.Limit
 
+	audit := auditEntryFromContext(r.Context())
+	for _, event := range events[:len(messages)] {
+		audit.AddRooms(event.RoomID)
+	}
+	audit.SetResultCount(len(messages))
+
 	response := &PaginatedMessagesWithCursors{
 		Items:        messages,
 		HasMore:      hasMore,
@@ -283,6 +281,81 @@ func (ab *BeeperIngestor) SearchMessages(w http.ResponseWriter, r *http.Request)
 	err = json.NewEncoder(w).Encode(response)
 	if err != nil {
 		log.Err(err).Msg("Failed to encode response")
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to encode response"))
+	}
+}
+
+// MessageExtra is the ingestor-specific metadata put in the extra field of a Message.
+type MessageExtra struct {
+	// Imported is set for messages that were loaded from an export file with `ingestor import` instead of synced.
+	Imported     bool   `json:"imported,omitempty"`
+	ImportSource string `json:"import_source,omitempty"`
+	// DecryptionError is set for encrypted messages that couldn't be decrypted, which are flagged with isErrored.
+	DecryptionError string `json:"decryption_error,omitempty"`
+}
+
+// eventToMessage converts a database event into the Platform SDK message shape.
+// The room is optional and only used for the room name.
+func (ab *BeeperIngestor) eventToMessage(event *database.Event, room *database.Room) Message {
+	permalinks := ab.Config().Permalinks
+	message := Message{
+		URL:       permalinks.EventURL(event.RoomID, event.ID),
+		Timestamp: event.Timestamp,
+		SenderID:  event.Sender.String(),
+		ID:        string(event.ID),
+		RoomInfo: &RoomInfo{
+			ID:  string(event.RoomID),
+			URL: permalinks.RoomURL(event.RoomID),
+		},
+	}
+
+	// Set room name from room info if available
+	if room != nil && room.Name != nil {
+		message.RoomInfo.Name = *room.Name
+	} else {
+		message.RoomInfo.Name = string(event.RoomID)
+	}
+
+	var extra MessageExtra
+	if failedToDecrypt(event) {
+		// The content is only ciphertext, so there's no text to return
+		message.IsErrored = true
+		extra.DecryptionError = event.DecryptionError
+	} else if event.LocalContent != nil && event.LocalContent.SanitizedHTML != "" {
+		message.Text = event.LocalContent.SanitizedHTML
+	} else {
+		var content struct {
+			Body string `json:"body"`
+		}
+		rawContent := rawMessageContent(event)
+		if err := json.Unmarshal(rawContent, &content); err == nil {
+			message.Text = content.Body
+		} else {
+			message.Text = string(rawContent)
+		}
+	}
+	var unsigned struct {
+		Age     int             `json:"age"`
+		HSOrder int             `json:"com.beeper.hs.order"`
+		Import  *ImportMetadata `json:"com.beeper.ingestor.import"`
+	}
+	if err := json.Unmarshal(event.Unsigned, &unsigned); err == nil {
+		message.SortKey = unsigned.HSOrder
+		if unsigned.Import != nil {
+			extra.Imported = true
+			extra.ImportSource = unsigned.Import.Source
+		}
+	}
+	if extra != (MessageExtra{}) {
+		message.Extra = &extra
+	}
+	return message
+}
+
+// rawMessageContent returns the decrypted content of the event if there is one, or the plaintext content otherwise.
+func rawMessageContent(event *database.Event) json.RawMessage {
+	if event.Decrypted != nil {
+		return event.Decrypted
 	}
+	return event.Content
 }
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// ShutdownConfig controls how the ingestor stops.
+type ShutdownConfig struct {
+	// DrainTimeout is how long in-flight requests, such as streaming exports, can continue after a shutdown signal.
+	// Requests that are still running after it are cancelled.
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+}
+
+func (cfg *ShutdownConfig) applyEnv() error {
+	return envDuration("SHUTDOWN_DRAIN_TIMEOUT", &cfg.DrainTimeout)
+}
+
+func (cfg *ShutdownConfig) validate() error {
+	if cfg.DrainTimeout < 0 {
+		return fmt.Errorf("drain_timeout can't be negative")
+	}
+	return nil
+}
+
+// cancelledRequestGracePeriod is how long cancelled requests get to return and write their audit log entries
+// before the database is closed.
+const cancelledRequestGracePeriod = 5 * time.Second
+
+// trackRequests counts running handlers, so that shutdown can wait for cancelled ones to return.
+// http.Server.Shutdown waits for them itself, but Close doesn't.
+func (ab *BeeperIngestor) trackRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ab.activeRequests.Add(1)
+		defer ab.activeRequests.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listen opens the TCP listener and the optional Unix socket, so that bind errors are reported before serving starts.
+func (ab *BeeperIngestor) listen() ([]net.Listener, error) {
+	address := ab.gmx.Config.Web.ListenAddress
+	tcpListener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	listeners := []net.Listener{tcpListener}
+	if unixSocket := ab.Config().Listener.UnixSocket; unixSocket != "" {
+		unixListener, err := listenUnix(unixSocket)
+		if err != nil {
+			_ = tcpListener.Close()
+			return nil, fmt.Errorf("failed to listen on %s: %w", unixSocket, err)
+		}
+		listeners = append(listeners, unixListener)
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix socket, replacing a stale socket file left behind by a previous run.
+func listenUnix(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0660); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// serve serves HTTP on a listener. If serving fails after startup, the ingestor is shut down
+// and exits with an error, rather than continuing to sync without an API.
+func (ab *BeeperIngestor) serve(listener net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = ab.gmx.Server.ServeTLS(listener, "", "")
+	} else {
+		err = ab.gmx.Server.Serve(listener)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		ab.gmx.Log.Err(err).Stringer("address", listener.Addr()).Msg("HTTP server failed, shutting down")
+		ab.serverFailed.Store(true)
+		ab.gmx.Stop()
+	}
+}
+
+// Stop shuts down the API first, waiting up to the drain timeout for in-flight requests,
+// and then stops the background workers and the sync loop and closes the database.
+// A second interrupt signal cancels the remaining requests immediately.
+func (ab *BeeperIngestor) Stop() {
+	log := ab.gmx.Log
+	drainTimeout := ab.Config().Shutdown.DrainTimeout
+	log.Info().Dur("drain_timeout", drainTimeout).Msg("Stopping API server")
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			log.Warn().Msg("Received another signal, cancelling in-flight requests")
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	if err := ab.gmx.Server.Shutdown(ctx); err != nil {
+		log.Warn().Err(err).Msg("Requests didn't finish in time, cancelling them")
+		ab.cancelRequests()
+		_ = ab.gmx.Server.Close()
+		done := make(chan struct{})
+		go func() {
+			ab.activeRequests.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(cancelledRequestGracePeriod):
+			log.Warn().Msg("Cancelled requests didn't return in time")
+		}
+	}
+	ab.cancelRequests()
+	log.Info().Msg("API server stopped")
+
+	ab.backfill.Stop()
+	ab.decryption.Stop()
+	// This also closes the database
+	ab.gmx.Client.Stop()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"go.mau.fi/gomuks/pkg/hicli"
+	"maunium.net/go/mautrix"
+)
+
+// SyncMonitor wraps the hicli syncer to record the outcome of every sync request.
+type SyncMonitor struct {
+	mautrix.Syncer
+	metrics *Metrics
+
+	lastSuccess         atomic.Int64
+	consecutiveFailures atomic.Int64
+}
+
+func (sm *SyncMonitor) ProcessResponse(ctx context.Context, resp *mautrix.RespSync, since string) error {
+	err := sm.Syncer.ProcessResponse(ctx, resp, since)
+	if err != nil {
+		// Processing errors stop the sync loop, so the failure count won't be reset until a restart
+		sm.recordFailure()
+	} else {
+		sm.lastSuccess.Store(time.Now().UnixMilli())
+		sm.consecutiveFailures.Store(0)
+		sm.metrics.RecordSync(true)
+	}
+	return err
+}
+
+func (sm *SyncMonitor) OnFailedSync(resp *mautrix.RespSync, err error) (time.Duration, error) {
+	sm.recordFailure()
+	return sm.Syncer.OnFailedSync(resp, err)
+}
+
+func (sm *SyncMonitor) recordFailure() {
+	sm.consecutiveFailures.Add(1)
+	sm.metrics.RecordSync(false)
+}
+
+// LastSuccess returns the time of the last successfully processed sync, or the zero time if there hasn't been one.
+func (sm *SyncMonitor) LastSuccess() time.Time {
+	if ts := sm.lastSuccess.Load(); ts != 0 {
+		return time.UnixMilli(ts)
+	}
+	return time.Time{}
+}
+
+// ConsecutiveFailures returns the number of sync requests that have failed since the last successful one.
+func (sm *SyncMonitor) ConsecutiveFailures() int64 {
+	return sm.consecutiveFailures.Load()
+}
+
+// startClient starts the gomuks client like gomuks.StartClient,
+// but with the sync monitor and decryption retrier installed before the first sync and metrics for stored events.
+func (ab *BeeperIngestor) startClient(ctx context.Context) error {
+	gmx := ab.gmx
+	hicli.HTMLSanitizerImgSrcTemplate = "_gomuks/media/%s/%s?encrypted=false"
+	jsonHandler := hicli.JSONEventHandler(gmx.OnEvent).HandleEvent
+	err := newClient(gmx, func(evt any) {
+		switch evt := evt.(type) {
+		case *hicli.SyncComplete:
+			for _, room := range evt.Rooms {
+				ab.metrics.RecordEvents("sync", room.Events)
+			}
+		case *hicli.EventsDecrypted:
+			ab.metrics.RecordLateDecryption(len(evt.Events))
+		}
+		jsonHandler(evt)
+	})
+	if err != nil {
+		return err
+	}
+	ab.decryption = newDecryptionRetrier(gmx.Client, gmx.Log.With().Str("component", "decryption_retrier").Logger())
+	ab.syncMonitor = &SyncMonitor{Syncer: gmx.Client.Client.Syncer, metrics: ab.metrics}
+	gmx.Client.Client.Syncer = ab.syncMonitor
+	userID, err := gmx.Client.DB.Account.GetFirstUserID(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get first user ID: %w", err)
+	}
+	if err = gmx.Client.Start(ctx, userID, nil); err != nil {
+		return fmt.Errorf("failed to start client: %w", err)
+	}
+	// hicli starts syncing by itself if the device is already verified
+	ab.syncStarted.Store(gmx.Client.Verified)
+	gmx.Log.Info().Stringer("user_id", userID).Msg("Client started")
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// ListenerConfig configures HTTPS, client certificate authentication and the Unix socket listener.
+type ListenerConfig struct {
+	// TLSCert and TLSKey are paths to a PEM certificate chain and private key. HTTPS is enabled if they're set.
+	TLSCert string `yaml:"tls_cert"`
+	TLSKey  string `yaml:"tls_key"`
+	// ClientCA is the path to a PEM bundle of CAs that client certificates are verified against.
+	// Client certificates are only requested if it's set.
+	ClientCA string `yaml:"client_ca"`
+	// RequireClientCert rejects TLS connections without a valid client certificate.
+	RequireClientCert bool `yaml:"require_client_cert"`
+	// ClientCertUsers maps client certificate subject common names to API usernames.
+	// If it's empty, the common name is used as the username directly.
+	ClientCertUsers map[string]string `yaml:"client_cert_users"`
+	// UnixSocket is the path of a Unix socket to serve plain HTTP on, in addition to the TCP listener.
+	UnixSocket string `yaml:"unix_socket"`
+}
+
+func (cfg *ListenerConfig) applyEnv() error {
+	envString("TLS_CERT", &cfg.TLSCert)
+	envString("TLS_KEY", &cfg.TLSKey)
+	envString("TLS_CLIENT_CA", &cfg.ClientCA)
+	envString("UNIX_SOCKET", &cfg.UnixSocket)
+	if rawUsers := os.Getenv("TLS_CLIENT_CERT_USERS"); rawUsers != "" {
+		cfg.ClientCertUsers = make(map[string]string)
+		for _, pair := range strings.Split(rawUsers, "|") {
+			commonName, username, ok := strings.Cut(pair, ":")
+			if !ok {
+				return fmt.Errorf("invalid TLS_CLIENT_CERT_USERS entry %q, expected commonname:username", pair)
+			}
+			cfg.ClientCertUsers[commonName] = username
+		}
+	}
+	return envBool("TLS_REQUIRE_CLIENT_CERT", &cfg.RequireClientCert)
+}
+
+func (cfg *ListenerConfig) validate() error {
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return fmt.Errorf("tls_cert and tls_key must be set together")
+	} else if cfg.ClientCA != "" && cfg.TLSCert == "" {
+		return fmt.Errorf("client_ca requires tls_cert and tls_key")
+	} else if cfg.RequireClientCert && cfg.ClientCA == "" {
+		return fmt.Errorf("require_client_cert requires client_ca")
+	}
+	for commonName, username := range cfg.ClientCertUsers {
+		if commonName == "" || username == "" {
+			return fmt.Errorf("invalid client_cert_users entry %q: %q", commonName, username)
+		}
+	}
+	return nil
+}
+
+// certReloaderCheckInterval is how often the certificate files are checked for changes.
+const certReloaderCheckInterval = 10 * time.Second
+
+// certReloader serves a TLS certificate from files and loads it again when the files change,
+// so that renewed certificates are picked up without a restart.
+type certReloader struct {
+	certPath string
+	keyPath  string
+	log      zerolog.Logger
+
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+	lock      sync.Mutex
+}
+
+func newCertReloader(certPath, keyPath string, log zerolog.Logger) (*certReloader, error) {
+	cr := &certReloader{certPath: certPath, keyPath: keyPath, log: log}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// latestModTime returns the newest modification time of the certificate and key files.
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, path := range []string{cr.certPath, cr.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return latest, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return fmt.Errorf("failed to stat TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+func (cr *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if time.Since(cr.lastCheck) > certReloaderCheckInterval {
+		cr.lastCheck = time.Now()
+		if modTime, err := cr.latestModTime(); err != nil {
+			cr.log.Warn().Err(err).Msg("Failed to check TLS certificate for changes")
+		} else if !modTime.Equal(cr.modTime) {
+			if err = cr.reload(); err != nil {
+				cr.log.Err(err).Msg("Failed to reload TLS certificate, keeping the previous one")
+			} else {
+				cr.log.Info().Time("modified_at", modTime).Msg("Reloaded TLS certificate")
+			}
+		}
+	}
+	return cr.cert, nil
+}
+
+// TLSConfig builds the server TLS configuration, or returns nil if HTTPS isn't enabled.
+func (lc *ListenerConfig) TLSConfig(log zerolog.Logger) (*tls.Config, error) {
+	if lc.TLSCert == "" {
+		return nil, nil
+	}
+	reloader, err := newCertReloader(lc.TLSCert, lc.TLSKey, log)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if lc.ClientCA != "" {
+		data, err := os.ReadFile(lc.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA bundle: %w", err)
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("client CA bundle %s doesn't contain any certificates", lc.ClientCA)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		if lc.RequireClientCert {
+			cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return cfg, nil
+}
+
+// clientCertAuthenticator maps verified TLS client certificates to API users, which get the same scopes as Basic
+// auth users with the same name. The certificate chain is verified against the client CA bundle during the TLS handshake.
+type clientCertAuthenticator struct {
+	users map[string]string
+	auth  *AuthConfig
+}
+
+func (ca *clientCertAuthenticator) Challenge() string {
+	return ""
+}
+
+func (ca *clientCertAuthenticator) Authenticate(r *http.Request) (*APIUser, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil, nil
+	}
+	commonName := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	username := commonName
+	if len(ca.users) > 0 {
+		var ok bool
+		if username, ok = ca.users[commonName]; !ok {
+			return nil, fmt.Errorf("%w: no user for client certificate %q", errInvalidCredentials, commonName)
+		}
+	}
+	if username == "" {
+		return nil, fmt.Errorf("%w: client certificate has no common name", errInvalidCredentials)
+	}
+	return &APIUser{Name: username, Scopes: ca.auth.userScopes(username), Method: "client_cert"}, nil
+}
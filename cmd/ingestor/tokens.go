@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/util/dbutil"
+	"go.mau.fi/util/jsontime"
+	"go.mau.fi/util/random"
+)
+
+// Scope is a permission that can be granted to an API token.
+type Scope string
+
+const (
+	ScopeMessagesRead Scope = "messages:read"
+	ScopeMediaRead    Scope = "media:read"
+	ScopeSend         Scope = "send"
+	ScopeAdmin        Scope = "admin"
+)
+
+var allScopes = []Scope{ScopeMessagesRead, ScopeMediaRead, ScopeSend, ScopeAdmin}
+
+// tokenNamespace is the prefix of API tokens, which makes them recognizable e.g. for secret scanners.
+const tokenNamespace = "ingt"
+
+const (
+	getAPITokenBaseQuery = `
+		SELECT id, label, username, token_hash, scopes, created_at, expires_at, last_used_at FROM api_token
+	`
+	getAPITokenByHashQuery = getAPITokenBaseQuery + `WHERE token_hash = $1`
+	getAllAPITokensQuery   = getAPITokenBaseQuery + `ORDER BY id`
+	insertAPITokenQuery    = `
+		INSERT INTO api_token (label, username, token_hash, scopes, created_at, expires_at, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	deleteAPITokenQuery         = `DELETE FROM api_token WHERE id = $1`
+	updateAPITokenLastUsedQuery = `UPDATE api_token SET last_used_at = $2 WHERE id = $1`
+)
+
+type APITokenQuery struct {
+	*dbutil.QueryHelper[*APIToken]
+}
+
+func (atq *APITokenQuery) GetByToken(ctx context.Context, token string) (*APIToken, error) {
+	return atq.QueryOne(ctx, getAPITokenByHashQuery, hashAPIToken(token))
+}
+
+func (atq *APITokenQuery) GetAll(ctx context.Context) ([]*APIToken, error) {
+	return atq.QueryMany(ctx, getAllAPITokensQuery)
+}
+
+func (atq *APITokenQuery) Insert(ctx context.Context, token *APIToken) error {
+	return atq.GetDB().QueryRow(ctx, insertAPITokenQuery, token.sqlVariables()...).Scan(&token.ID)
+}
+
+// Delete deletes a token and returns false if it didn't exist.
+func (atq *APITokenQuery) Delete(ctx context.Context, id int64) (bool, error) {
+	res, err := atq.GetDB().Exec(ctx, deleteAPITokenQuery, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := res.RowsAffected()
+	return affected > 0, err
+}
+
+func (atq *APITokenQuery) UpdateLastUsed(ctx context.Context, token *APIToken) error {
+	token.LastUsedAt = jsontime.UM(time.Now())
+	return atq.Exec(ctx, updateAPITokenLastUsedQuery, token.ID, token.LastUsedAt)
+}
+
+// APIToken is a bearer token for the API. Only the hash of the token is stored.
+type APIToken struct {
+	ID    int64
+	Label string
+	// Username is the API user the token acts as, which decides the room access rules that apply.
+	Username   string
+	TokenHash  string
+	Scopes     []Scope
+	CreatedAt  jsontime.UnixMilli
+	ExpiresAt  jsontime.UnixMilli
+	LastUsedAt jsontime.UnixMilli
+}
+
+func (t *APIToken) Scan(row dbutil.Scannable) (*APIToken, error) {
+	var scopes string
+	var expiresAt, lastUsedAt sql.NullInt64
+	err := row.Scan(&t.ID, &t.Label, &t.Username, &t.TokenHash, &scopes, &t.CreatedAt, &expiresAt, &lastUsedAt)
+	if err != nil {
+		return nil, err
+	}
+	for _, scope := range strings.Fields(scopes) {
+		t.Scopes = append(t.Scopes, Scope(scope))
+	}
+	if expiresAt.Valid {
+		t.ExpiresAt = jsontime.UMInt(expiresAt.Int64)
+	}
+	if lastUsedAt.Valid {
+		t.LastUsedAt = jsontime.UMInt(lastUsedAt.Int64)
+	}
+	return t, nil
+}
+
+func (t *APIToken) sqlVariables() []any {
+	scopes := make([]string, len(t.Scopes))
+	for i, scope := range t.Scopes {
+		scopes[i] = string(scope)
+	}
+	return []any{
+		t.Label, t.Username, t.TokenHash, strings.Join(scopes, " "), t.CreatedAt,
+		nullableUnixMilli(t.ExpiresAt), nullableUnixMilli(t.LastUsedAt),
+	}
+}
+
+func (t *APIToken) IsExpired() bool {
+	return !t.ExpiresAt.IsZero() && time.Now().After(t.ExpiresAt.Time)
+}
+
+func nullableUnixMilli(ts jsontime.UnixMilli) *int64 {
+	if ts.IsZero() {
+		return nil
+	}
+	val := ts.UnixMilli()
+	return &val
+}
+
+func hashAPIToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// NewAPIToken generates a new token and stores its hash. The plaintext token is only returned here.
+func (db *IngestorDatabase) NewAPIToken(ctx context.Context, label, username string, scopes []Scope, expiresAt time.Time) (string, *APIToken, error) {
+	plaintext := random.Token(tokenNamespace, 32)
+	token := &APIToken{
+		Label:     label,
+		Username:  username,
+		TokenHash: hashAPIToken(plaintext),
+		Scopes:    scopes,
+		CreatedAt: jsontime.UM(time.Now()),
+	}
+	if !expiresAt.IsZero() {
+		token.ExpiresAt = jsontime.UM(expiresAt)
+	}
+	if err := db.Token.Insert(ctx, token); err != nil {
+		return "", nil, err
+	}
+	return plaintext, token, nil
+}
+
+// parseScopes parses a comma-separated list of scopes.
+func parseScopes(input string) ([]Scope, error) {
+	var scopes []Scope
+	for _, part := range strings.Split(input, ",") {
+		scope := Scope(strings.TrimSpace(part))
+		if scope == "" {
+			continue
+		} else if !slices.Contains(allScopes, scope) {
+			return nil, fmt.Errorf("unknown scope %q", scope)
+		} else if !slices.Contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("at least one scope is required")
+	}
+	return scopes, nil
+}
+
+// parseExpiry parses a token lifetime like "720h" or "90d", or an expiry date in YYYY-MM-DD format.
+func parseExpiry(input string, now time.Time) (time.Time, error) {
+	if input == "" || input == "never" {
+		return time.Time{}, nil
+	} else if days, ok := strings.CutSuffix(input, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil && n > 0 {
+			return now.AddDate(0, 0, n), nil
+		}
+	} else if dur, err := time.ParseDuration(input); err == nil && dur > 0 {
+		return now.Add(dur), nil
+	} else if date, err := time.ParseInLocation(time.DateOnly, input, time.Local); err == nil {
+		return date, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry %q, expected a duration like 90d or 12h, a YYYY-MM-DD date or never", input)
+}
+
+func formatTokenTime(ts jsontime.UnixMilli, ifZero string) string {
+	if ts.IsZero() {
+		return ifZero
+	}
+	return ts.Local().Format(time.DateTime)
+}
+
+func cmdToken(gmx *gomuks.Gomuks, fs *CommandFlags) error {
+	label := fs.MakeFull("l", "label", "Label of the new token, e.g. who or what it's for.", "").String()
+	username := fs.MakeFull("u", "user", "API user the new token acts as for room access rules. Defaults to the label.", "").String()
+	rawScopes := fs.MakeFull("s", "scopes", "Comma-separated scopes of the new token: messages:read, media:read, send, admin.", "messages:read").String()
+	rawExpiry := fs.MakeFull("e", "expires", "Lifetime (e.g. 90d) or expiry date (YYYY-MM-DD) of the new token.", "never").String()
+	if ok, err := fs.Parse(); !ok {
+		return err
+	}
+	var run func(ctx context.Context, db *IngestorDatabase) error
+	switch fs.Arg(0) {
+	case "create":
+		if *label == "" {
+			return fmt.Errorf("a label is required for new tokens")
+		} else if *username == "" {
+			*username = *label
+		}
+		scopes, err := parseScopes(*rawScopes)
+		if err != nil {
+			return err
+		}
+		expiresAt, err := parseExpiry(*rawExpiry, time.Now())
+		if err != nil {
+			return err
+		}
+		run = func(ctx context.Context, db *IngestorDatabase) error {
+			plaintext, token, err := db.NewAPIToken(ctx, *label, *username, scopes, expiresAt)
+			if err != nil {
+				return fmt.Errorf("failed to create token: %w", err)
+			}
+			_, _ = fmt.Fprintf(os.Stderr, "Created token %d, it won't be shown again:\n", token.ID)
+			fmt.Println(plaintext)
+			return nil
+		}
+	case "list":
+		run = func(ctx context.Context, db *IngestorDatabase) error {
+			tokens, err := db.Token.GetAll(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to list tokens: %w", err)
+			}
+			tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+			_, _ = fmt.Fprintln(tw, "ID\tLABEL\tUSER\tSCOPES\tCREATED\tEXPIRES\tLAST USED")
+			for _, token := range tokens {
+				scopes := make([]string, len(token.Scopes))
+				for i, scope := range token.Scopes {
+					scopes[i] = string(scope)
+				}
+				expires := formatTokenTime(token.ExpiresAt, "never")
+				if token.IsExpired() {
+					expires += " (expired)"
+				}
+				_, _ = fmt.Fprintf(
+					tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+					token.ID, token.Label, token.Username, strings.Join(scopes, ","),
+					formatTokenTime(token.CreatedAt, ""), expires, formatTokenTime(token.LastUsedAt, "never"),
+				)
+			}
+			return tw.Flush()
+		}
+	case "revoke":
+		if fs.NArg() != 2 {
+			return fmt.Errorf("usage: ingestor token revoke <token ID>")
+		}
+		tokenID, err := strconv.ParseInt(fs.Arg(1), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid token ID %q", fs.Arg(1))
+		}
+		run = func(ctx context.Context, db *IngestorDatabase) error {
+			if found, err := db.Token.Delete(ctx, tokenID); err != nil {
+				return fmt.Errorf("failed to revoke token: %w", err)
+			} else if !found {
+				return fmt.Errorf("token %d not found", tokenID)
+			}
+			_, _ = fmt.Fprintf(os.Stderr, "Revoked token %d\n", tokenID)
+			return nil
+		}
+	default:
+		fs.PrintHelp()
+		return fmt.Errorf("expected create, list or revoke")
+	}
+	db, err := openIngestorDatabase(gmx)
+	if err != nil {
+		return err
+	}
+	defer closeClient(gmx)
+	return run(gmx.Log.WithContext(context.Background()), db)
+}
@@ -0,0 +1,43 @@
+-- v0 -> v3: Latest revision
+CREATE TABLE backfill_progress (
+	room_id          TEXT    NOT NULL PRIMARY KEY,
+	status           TEXT    NOT NULL,
+	event_count      INTEGER NOT NULL DEFAULT 0,
+	oldest_timestamp INTEGER,
+	last_error       TEXT,
+	updated_at       INTEGER NOT NULL,
+
+	CONSTRAINT backfill_progress_room_fkey FOREIGN KEY (room_id) REFERENCES room (room_id) ON DELETE CASCADE
+) STRICT;
+
+CREATE TABLE api_token (
+	id           INTEGER NOT NULL PRIMARY KEY,
+	label        TEXT    NOT NULL,
+	username     TEXT    NOT NULL,
+	token_hash   TEXT    NOT NULL,
+	scopes       TEXT    NOT NULL,
+	created_at   INTEGER NOT NULL,
+	expires_at   INTEGER,
+	last_used_at INTEGER,
+
+	CONSTRAINT api_token_hash_unique UNIQUE (token_hash)
+) STRICT;
+
+CREATE TABLE audit_log (
+	id           INTEGER NOT NULL PRIMARY KEY,
+	timestamp    INTEGER NOT NULL,
+	request_id   TEXT    NOT NULL,
+	username     TEXT,
+	auth_method  TEXT,
+	remote_addr  TEXT    NOT NULL,
+	method       TEXT    NOT NULL,
+	path         TEXT    NOT NULL,
+	query        TEXT    NOT NULL,
+	status_code  INTEGER NOT NULL,
+	room_ids     TEXT    NOT NULL,
+	result_count INTEGER NOT NULL,
+	latency_ms   INTEGER NOT NULL
+) STRICT;
+
+CREATE INDEX audit_log_timestamp_idx ON audit_log (timestamp);
+CREATE INDEX audit_log_username_idx ON audit_log (username);
@@ -0,0 +1,13 @@
+-- v1 -> v2: Add API tokens
+CREATE TABLE api_token (
+	id           INTEGER NOT NULL PRIMARY KEY,
+	label        TEXT    NOT NULL,
+	username     TEXT    NOT NULL,
+	token_hash   TEXT    NOT NULL,
+	scopes       TEXT    NOT NULL,
+	created_at   INTEGER NOT NULL,
+	expires_at   INTEGER,
+	last_used_at INTEGER,
+
+	CONSTRAINT api_token_hash_unique UNIQUE (token_hash)
+) STRICT;
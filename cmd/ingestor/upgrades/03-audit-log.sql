@@ -0,0 +1,19 @@
+-- v2 -> v3: Add audit log
+CREATE TABLE audit_log (
+	id           INTEGER NOT NULL PRIMARY KEY,
+	timestamp    INTEGER NOT NULL,
+	request_id   TEXT    NOT NULL,
+	username     TEXT,
+	auth_method  TEXT,
+	remote_addr  TEXT    NOT NULL,
+	method       TEXT    NOT NULL,
+	path         TEXT    NOT NULL,
+	query        TEXT    NOT NULL,
+	status_code  INTEGER NOT NULL,
+	room_ids     TEXT    NOT NULL,
+	result_count INTEGER NOT NULL,
+	latency_ms   INTEGER NOT NULL
+) STRICT;
+
+CREATE INDEX audit_log_timestamp_idx ON audit_log (timestamp);
+CREATE INDEX audit_log_username_idx ON audit_log (username);
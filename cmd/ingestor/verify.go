@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/hlog"
+	"go.mau.fi/gomuks/pkg/gomuks"
+	"go.mau.fi/gomuks/pkg/hicli"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/crypto/backup"
+	"maunium.net/go/mautrix/crypto/ssss"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+)
+
+// VerifyRequest is the request body of the verify endpoint.
+type VerifyRequest struct {
+	RecoveryKey string `json:"recovery_key"`
+}
+
+// VerifyResponse is the result of verifying the ingestor's device and restoring the key backup.
+type VerifyResponse struct {
+	UserID    id.UserID              `json:"user_id"`
+	DeviceID  id.DeviceID            `json:"device_id"`
+	KeyBackup KeyBackupRestoreResult `json:"key_backup"`
+}
+
+// KeyBackupRestoreResult counts the megolm sessions in the server-side key backup.
+type KeyBackupRestoreResult struct {
+	Version id.KeyBackupVersion `json:"version"`
+	// Imported sessions were new or better than the ones the ingestor already had.
+	Imported int `json:"imported"`
+	// Skipped sessions were already known from an equal or earlier message index.
+	Skipped int `json:"skipped"`
+	// Failed sessions couldn't be decrypted or imported.
+	Failed int `json:"failed"`
+}
+
+// verifyDevice verifies the ingestor's device with the SSSS recovery key and restores the server-side key backup.
+//
+// It does the same as hicli's VerifyWithRecoveryKey, except that it doesn't start syncing,
+// so that the verify command can run without taking over the sync of a running ingestor.
+// Importing the backed up sessions retries decryption of stored events that failed to decrypt.
+func verifyDevice(ctx context.Context, h *hicli.HiClient, recoveryKey string) (*VerifyResponse, error) {
+	keyID, keyData, err := h.Crypto.SSSS.GetDefaultKeyData(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get default SSSS key data: %w", err)
+	}
+	key, err := keyData.VerifyRecoveryKey(keyID, strings.TrimSpace(recoveryKey))
+	if err != nil {
+		return nil, err
+	}
+	if err = h.Crypto.FetchCrossSigningKeysFromSSSS(ctx, key); err != nil {
+		return nil, fmt.Errorf("failed to fetch cross-signing keys from SSSS: %w", err)
+	} else if err = h.Crypto.SignOwnDevice(ctx, h.Crypto.OwnIdentity()); err != nil {
+		return nil, fmt.Errorf("failed to sign own device: %w", err)
+	} else if err = h.Crypto.SignOwnMasterKey(ctx); err != nil {
+		return nil, fmt.Errorf("failed to sign own master key: %w", err)
+	}
+	// The device list of the own user isn't fetched before the first sync,
+	// so fetch it now to have the cross-signing public keys and the new signatures in the store.
+	if _, err = h.Crypto.FetchKeys(ctx, []id.UserID{h.Account.UserID}, true); err != nil {
+		return nil, fmt.Errorf("failed to fetch own cross-signing keys: %w", err)
+	}
+	seeds := map[id.Secret][]byte{
+		id.SecretXSMaster:      h.Crypto.CrossSigningKeys.MasterKey.Seed(),
+		id.SecretXSSelfSigning: h.Crypto.CrossSigningKeys.SelfSigningKey.Seed(),
+		id.SecretXSUserSigning: h.Crypto.CrossSigningKeys.UserSigningKey.Seed(),
+	}
+	for secret, seed := range seeds {
+		if err = h.CryptoStore.PutSecret(ctx, secret, base64.StdEncoding.EncodeToString(seed)); err != nil {
+			return nil, fmt.Errorf("failed to store %s: %w", secret, err)
+		}
+	}
+
+	versionInfo, err := h.Client.GetKeyBackupLatestVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get latest key backup version: %w", err)
+	}
+	backupKeyData, err := h.Crypto.SSSS.GetDecryptedAccountData(ctx, event.AccountDataMegolmBackupKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get megolm backup key from SSSS: %w", err)
+	}
+	backupKey, err := backup.MegolmBackupKeyFromBytes(backupKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse megolm backup key: %w", err)
+	}
+	err = h.CryptoStore.PutSecret(ctx, id.SecretMegolmBackupV1, base64.StdEncoding.EncodeToString(backupKey.Bytes()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to store megolm backup key: %w", err)
+	}
+	h.KeyBackupVersion = versionInfo.Version
+	h.KeyBackupKey = backupKey
+	h.Verified = true
+
+	result, err := restoreKeyBackup(ctx, h)
+	if err != nil {
+		return nil, err
+	}
+	return &VerifyResponse{UserID: h.Account.UserID, DeviceID: h.Account.DeviceID, KeyBackup: *result}, nil
+}
+
+// restoreKeyBackup imports every session in the latest server-side key backup that the ingestor doesn't have yet.
+func restoreKeyBackup(ctx context.Context, h *hicli.HiClient) (*KeyBackupRestoreResult, error) {
+	log := zerolog.Ctx(ctx)
+	keys, err := h.Client.GetKeyBackup(ctx, h.KeyBackupVersion)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get key backup: %w", err)
+	}
+	result := &KeyBackupRestoreResult{Version: h.KeyBackupVersion}
+	for roomID, room := range keys.Rooms {
+		for sessionID, data := range room.Sessions {
+			existing, err := h.CryptoStore.GetGroupSession(ctx, roomID, sessionID)
+			if err != nil {
+				log.Warn().Err(err).
+					Stringer("room_id", roomID).
+					Stringer("session_id", sessionID).
+					Msg("Failed to check existing megolm session")
+			} else if existing != nil && existing.Internal.FirstKnownIndex() <= uint32(data.FirstMessageIndex) {
+				result.Skipped++
+				continue
+			}
+			decrypted, err := data.SessionData.Decrypt(h.KeyBackupKey)
+			if err == nil {
+				_, err = h.Crypto.ImportRoomKeyFromBackup(ctx, h.KeyBackupVersion, roomID, sessionID, decrypted)
+			}
+			if err != nil {
+				log.Warn().Err(err).
+					Stringer("room_id", roomID).
+					Stringer("session_id", sessionID).
+					Msg("Failed to import megolm session from key backup")
+				result.Failed++
+			} else {
+				result.Imported++
+			}
+		}
+	}
+	log.Info().
+		Str("version", string(result.Version)).
+		Int("imported", result.Imported).
+		Int("skipped", result.Skipped).
+		Int("failed", result.Failed).
+		Msg("Restored key backup")
+	return result, nil
+}
+
+func cmdVerify(gmx *gomuks.Gomuks, fs *CommandFlags) error {
+	withRecoveryKey := fs.Make().LongKey("recovery-key").Usage("Verify with the recovery key read from stdin.").Bool()
+	if ok, err := fs.Parse(); !ok {
+		return err
+	} else if fs.NArg() > 0 {
+		return fmt.Errorf("the recovery key is read from stdin, not arguments, to keep it out of shell history")
+	} else if !*withRecoveryKey {
+		fs.PrintHelp()
+		return fmt.Errorf("--recovery-key is required")
+	}
+	if err := openClient(gmx); errors.Is(err, errNotLoggedIn) {
+		return fmt.Errorf("%w, run `ingestor login` first", err)
+	} else if err != nil {
+		return err
+	}
+	defer closeClient(gmx)
+	recoveryKey, err := readSecret("Recovery key: ")
+	if err != nil {
+		return err
+	}
+	resp, err := verifyDevice(gmx.Log.WithContext(context.Background()), gmx.Client, recoveryKey)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "Verified device %s of %s\n", resp.DeviceID, resp.UserID)
+	_, _ = fmt.Fprintf(
+		os.Stderr, "Restored key backup version %s: %d sessions imported, %d already known, %d failed\n",
+		resp.KeyBackup.Version, resp.KeyBackup.Imported, resp.KeyBackup.Skipped, resp.KeyBackup.Failed,
+	)
+	return nil
+}
+
+// VerifyDevice verifies the device with a recovery key, restores the key backup and starts syncing if the
+// ingestor wasn't syncing yet because the device was unverified.
+func (ab *BeeperIngestor) VerifyDevice(w http.ResponseWriter, r *http.Request) {
+	log := hlog.FromRequest(r)
+	var req VerifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, r, mautrix.MNotJSON.WithMessage("Request body is not valid JSON"))
+		return
+	} else if strings.TrimSpace(req.RecoveryKey) == "" {
+		writeError(w, r, errInvalidParam("recovery_key", "Recovery key is required"))
+		return
+	}
+	h, ok := ab.loggedInClient(w, r)
+	if !ok {
+		return
+	}
+	ab.verifyLock.Lock()
+	defer ab.verifyLock.Unlock()
+	resp, err := verifyDevice(r.Context(), h, req.RecoveryKey)
+	if errors.Is(err, ssss.ErrInvalidRecoveryKey) || errors.Is(err, ssss.ErrIncorrectSSSSKey) {
+		writeError(w, r, errInvalidParam("recovery_key", "Invalid recovery key"))
+		return
+	} else if err != nil {
+		log.Err(err).Msg("Failed to verify device")
+		writeError(w, r, mautrix.MUnknown.WithMessage("Failed to verify device: %v", err))
+		return
+	}
+	ab.startSync()
+	w.Header().Set("Content-Type", "application/json")
+	if err = json.NewEncoder(w).Encode(resp); err != nil {
+		log.Err(err).Msg("Failed to encode response")
+	}
+}
+
+// startSync starts the sync loop after the device was verified, unless it was already started. hicli's Sync
+// restarts a running loop, and concurrent calls leave all but one goroutine blocked on its sync lock.
+func (ab *BeeperIngestor) startSync() {
+	if ab.syncStarted.CompareAndSwap(false, true) {
+		go ab.gmx.Client.Sync()
+	}
+}
+
+// loggedInClient returns the client for endpoints that need the ingestor's account, or writes an error if the
+// ingestor isn't logged in.
+func (ab *BeeperIngestor) loggedInClient(w http.ResponseWriter, r *http.Request) (*hicli.HiClient, bool) {
+	h := ab.gmx.Client
+	if h == nil || !h.IsLoggedIn() {
+		writeError(w, r, mautrix.MUnknown.WithMessage("The ingestor isn't logged in").WithStatus(http.StatusServiceUnavailable))
+		return nil, false
+	}
+	return h, true
+}
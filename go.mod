@@ -7,28 +7,46 @@ toolchain go1.23.2
 replace go.mau.fi/gomuks => github.com/batuhan/gomuks v0.0.0-20241110152851-37608d94dd14
 
 require (
+	github.com/chzyer/readline v1.5.1
+	github.com/coder/websocket v1.8.12
+	github.com/go-jose/go-jose/v4 v4.0.5
 	github.com/mattn/go-sqlite3 v1.14.24
+	github.com/parquet-go/parquet-go v0.24.0
+	github.com/prometheus/client_golang v1.20.5
 	github.com/rs/zerolog v1.33.0
+	github.com/tidwall/sjson v1.2.5
 	go.mau.fi/util v0.8.2-0.20241030110711-b3e597e16b74
+	go.mau.fi/zeroconfig v0.1.3
+	golang.org/x/crypto v0.32.0
+	golang.org/x/sync v0.8.0
+	gopkg.in/yaml.v3 v3.0.1
 	maunium.net/go/mauflag v1.0.0
 	maunium.net/go/mautrix v0.21.2-0.20241102114451-83e60efa1558
 )
 
 require (
 	github.com/alecthomas/chroma/v2 v2.14.0 // indirect
-	github.com/chzyer/readline v1.5.1 // indirect
-	github.com/coder/websocket v1.8.12 // indirect
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/gabriel-vasile/mimetype v1.4.6 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/kr/text v0.2.0 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
+	github.com/mattn/go-runewidth v0.0.15 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
+	github.com/olekukonko/tablewriter v0.0.5 // indirect
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
 	github.com/tidwall/gjson v1.18.0 // indirect
-	github.com/tidwall/sjson v1.2.5 // indirect
 	github.com/yuin/goldmark v1.7.8 // indirect
-	go.mau.fi/zeroconfig v0.1.3 // indirect
-	golang.org/x/crypto v0.28.0 // indirect
 	golang.org/x/image v0.21.0 // indirect
 	golang.org/x/net v0.30.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	google.golang.org/protobuf v1.35.1 // indirect
 	mvdan.cc/xurls/v2 v2.5.0 // indirect
 )
 
@@ -44,6 +62,6 @@ require (
 	github.com/tidwall/pretty v1.2.0 // indirect
 	go.mau.fi/gomuks v0.0.0-00010101000000-000000000000
 	golang.org/x/exp v0.0.0-20241009180824-f66d83c29e7c // indirect
-	golang.org/x/sys v0.26.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
 	gopkg.in/natefinch/lumberjack.v2 v2.2.1 // indirect
 )